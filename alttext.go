@@ -0,0 +1,60 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"strings"
+)
+
+// MaxAltTextLength is the maximum number of characters Twitter accepts as
+// alt text of an image.
+const MaxAltTextLength = 1000
+
+// AltTextsForTweet returns alt texts for the caption images of the tweet in
+// the order GenerateFileNamesForTweet lists them.
+func AltTextsForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet) []string {
+	data := GetCaptionDataForTweet(tw, quotedTweet)
+	fNameInfo := GenerateFileNamesForTweet(tw, quotedTweet)
+
+	descriptions := map[string]string{}
+	for _, t := range []*twigger.Tweet{&tw, quotedTweet} {
+		if t == nil {
+			continue
+		}
+		for _, m := range t.ExtendedEntities.Media {
+			descriptions[m.Media_url_https] = m.ExtAltText
+		}
+	}
+
+	texts := make([]string, len(fNameInfo))
+	for i, info := range fNameInfo {
+		parts := []string{}
+		if info.MediaTweet {
+			parts = append(parts, fmt.Sprintf("Image %v of %v from a tweet by %v (@%v), captioned with the tweet's text.",
+				i+1, len(fNameInfo), data.Name, data.ScreenName))
+			if desc := strings.TrimSpace(descriptions[info.MediaURL]); desc != "" {
+				parts = append(parts, fmt.Sprintf("Original image description: %v", desc))
+			}
+		} else {
+			parts = append(parts, fmt.Sprintf("Text of a tweet by %v (@%v).", data.Name, data.ScreenName))
+		}
+		parts = append(parts, fmt.Sprintf("URL: %v", data.URL))
+		parts = append(parts, fmt.Sprintf("Tweet: %v", data.Text))
+		if q := data.Quoted; q != nil {
+			parts = append(parts, fmt.Sprintf("Quoted tweet by %v (@%v): %v", q.Name, q.ScreenName, q.Text))
+		}
+		parts = append(parts, data.Warnings...)
+		texts[i] = TruncateText(strings.Join(parts, " "), MaxAltTextLength)
+	}
+	return texts
+}
+
+// TruncateText shortens text to at most limit characters, marking the cut
+// with an ellipsis.
+func TruncateText(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:limit-1])) + "…"
+}
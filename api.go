@@ -3,7 +3,7 @@ package twcapbot
 import (
 	"embed"
 	"fmt"
-	"github.com/gusanmaz/capdec"
+	"github.com/ChimeraCoder/anaconda"
 	"github.com/gusanmaz/twigger"
 	"io"
 	"io/ioutil"
@@ -23,6 +23,20 @@ type TweetCaptionBot struct {
 	HairPhotoPath string
 	InfoLog       *log.Logger
 	ErrLog        *log.Logger
+	OptOuts       *OptOutList // Authors in this list are never captioned
+	Card          CardOptions // Appearance of images rendered for text-only tweets
+	Renderer      Renderer    // Attaches captions to tweet media
+	Captions      CaptionOptions
+	Layout        Layout // Paths of written files, PerUserLayout if nil
+
+	// If set, media is copied from files saved by earlier runs instead of
+	// being downloaded
+	LocalMedia *MediaIndex
+
+	// If set, each page request of the tweet sources in sources.go goes
+	// through Throttle, e.g. to wait for rate limits to reset and repeat
+	// the request instead of starting over.
+	Throttle func(request func() error) error
 }
 
 const botLogPrefix = "Tweet Caption Bot: "
@@ -33,9 +47,26 @@ func init() {
 }
 
 func New(creds twigger.Credentials, logFile *os.File, codes []string, outDirPath string) *TweetCaptionBot {
+	tConn, err := twigger.NewConnection(creds, logFile, os.Stdout, os.Stderr)
+	if err != nil {
+		log.Panicf("Cannot create a new connection for twigger. Error: %v", err)
+	}
+	bot := newBot(codes, outDirPath, tConn.InfoLog.Writer(), tConn.ErrLog.Writer())
+	bot.TwiggerConn = tConn
+	return bot
+}
+
+func newBot(codes []string, outDirPath string, infoW, errW io.Writer) *TweetCaptionBot {
 	bot := TweetCaptionBot{}
 	bot.JSCodes = codes
 	bot.OutDirPath = outDirPath
+	bot.Card = DefaultCardOptions()
+
+	renderer, err := NewRenderer("", codes)
+	if err != nil {
+		log.Panicf("Cannot create the caption renderer. Error: %v", err)
+	}
+	bot.Renderer = renderer
 
 	finfo, err := os.Stat(outDirPath)
 
@@ -43,12 +74,6 @@ func New(creds twigger.Credentials, logFile *os.File, codes []string, outDirPath
 		log.Panicf("%v is not a valid directory", outDirPath)
 	}
 
-	tConn, err := twigger.NewConnection(creds, logFile, os.Stdout, os.Stderr)
-	if err != nil {
-		log.Panicf("Cannot create a new connection for twigger. Error: %v", err)
-	}
-	bot.TwiggerConn = tConn
-
 	f, err := embedFS.Open("hair.png")
 	if err != nil {
 		log.Panicf("Cannot open hair.png. Error: %v", err)
@@ -64,91 +89,152 @@ func New(creds twigger.Credentials, logFile *os.File, codes []string, outDirPath
 		log.Panicf("Cannot copy hair.png into temporary directory. Error: %v", err)
 	}
 
-	infoW := tConn.InfoLog.Writer()
 	bot.InfoLog = log.New(infoW, botLogPrefix, log.LstdFlags)
-
-	errW := tConn.ErrLog.Writer()
 	bot.ErrLog = log.New(errW, botLogPrefix, log.LstdFlags)
 
 	bot.HairPhotoPath = filepath.Join(tempF.Name())
 	return &bot
 }
 
-func (b *TweetCaptionBot) CaptionTweet(id int64, rootPath string) error {
-	tw, err := b.TwiggerConn.GetSingleTweetFromID(id)
+// GetTweet retrieves the tweet with the given ID. Unlike twigger, it
+// reports a tweet that cannot be retrieved as an error.
+func (b *TweetCaptionBot) GetTweet(id int64) (twigger.Tweet, error) {
+	tw, err := b.TwiggerConn.Client.GetTweet(id, nil)
 	if err != nil {
-		return err
+		b.ErrLog.Printf("Tweet with ID of %v cannot be retrieved. Error: %v", id, err)
+		return twigger.Tweet{}, err
+	}
+	if tw.Id == 0 {
+		return twigger.Tweet{}, ErrTweetUnavailable
+	}
+	return twigger.Tweet(tw), nil
+}
+
+// CheckTweet returns an error if the tweet must not be captioned. Retweets
+// are checked against the author of the retweeted tweet as well, whose text
+// and media they show.
+func (b *TweetCaptionBot) CheckTweet(tw twigger.Tweet) error {
+	if tw.Id == 0 {
+		return ErrTweetUnavailable
+	}
+	users := []anaconda.User{tw.User}
+	if tw.RetweetedStatus != nil {
+		users = append(users, tw.RetweetedStatus.User)
+	}
+	for _, u := range users {
+		if u.Protected {
+			return ErrProtectedAccount
+		}
+		if b.OptOuts.Contains(u.IdStr) {
+			return ErrOptedOut
+		}
+	}
+	return nil
+}
+
+// FetchTweet retrieves the tweet with the given ID and the tweet it quotes
+// if there is any. A quoted tweet that cannot be captioned is left out.
+func (b *TweetCaptionBot) FetchTweet(id int64) (twigger.Tweet, *twigger.Tweet, error) {
+	tw, err := b.GetTweet(id)
+	if err != nil {
+		return tw, nil, err
+	}
+	err = b.CheckTweet(tw)
+	if err != nil {
+		return tw, nil, err
 	}
 
 	var quotedTweet *twigger.Tweet = nil
 	if tw.QuotedStatusID != 0 {
-		tw, err := b.TwiggerConn.GetSingleTweetFromID(tw.QuotedStatusID)
-		if err != nil {
-			return err
+		qt, err := b.GetTweet(tw.QuotedStatusID)
+		if err == nil {
+			err = b.CheckTweet(qt)
+		}
+		if err == nil {
+			quotedTweet = &qt
+		} else {
+			b.InfoLog.Printf("Quoted tweet (ID: %v) of tweet (ID: %v) is left out: %v", tw.QuotedStatusID, tw.Id, err)
 		}
-		quotedTweet = &tw
 	}
+	return tw, quotedTweet, nil
+}
 
-	fNameInfo := GenerateFileNamesForTweet(tw, quotedTweet)
-	userDirPath := filepath.Join(rootPath, fNameInfo[0].ShortDirName)
-
-	_, err = os.Stat(rootPath)
+func (b *TweetCaptionBot) CaptionTweet(id int64, rootPath string) error {
+	tw, quotedTweet, err := b.FetchTweet(id)
 	if err != nil {
-		err = os.Mkdir(rootPath, 0750)
-		if err != nil {
-			b.ErrLog.Printf("Cannot create directory: %v! Error message: %v", userDirPath, err)
-			panic("Exiting program...")
-		}
+		return err
 	}
+	return b.CaptionFetchedTweet(tw, quotedTweet, rootPath)
+}
 
-	_, err = os.Stat(userDirPath)
+// CaptionFetchedTweet captions an already retrieved tweet. quotedTweet should
+// be nil unless tw quotes a tweet.
+func (b *TweetCaptionBot) CaptionFetchedTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet, rootPath string) error {
+	err := b.CheckTweet(tw)
 	if err != nil {
-		err = os.Mkdir(userDirPath, 0750)
-		if err != nil {
-			b.ErrLog.Printf("Cannot create directory: %v! Error message: %v", userDirPath, err)
-			panic("Exiting program...")
-		}
+		return err
+	}
+
+	fNameInfo := GenerateFileNamesForTweet(tw, quotedTweet)
+	layout := b.layout()
+
+	var meta *TweetMetadata
+	if b.Captions.Metadata.Enabled() {
+		m := b.TweetMetadata(tw)
+		meta = &m
 	}
+	captions := GetCaptionsForTweet(tw, quotedTweet, b.Captions, meta)
 
 	for _, v := range fNameInfo {
-		srcPath := filepath.Join(userDirPath, v.LongFileName)
-		destFilePath := filepath.Join(userDirPath, v.LongCaptionFileName)
+		paths := layout.Paths(tw, v)
+		srcPath := filepath.Join(rootPath, paths.Media)
+		destFilePath := filepath.Join(rootPath, paths.Caption)
+		dirs := []string{destFilePath}
+		if v.MediaTweet {
+			dirs = append(dirs, srcPath)
+		}
+		err := b.makeDirs(dirs...)
+		if err != nil {
+			return err
+		}
+		mediaPath := ""
 		b.InfoLog.Printf("Captioning of tweet with IDStr of %v has started", tw.Id)
 		if v.MediaTweet {
-			err := DownloadTo(v.MediaURL, srcPath)
+			mediaPath = srcPath
+			err = b.fetchMedia(v, srcPath, tw.Id)
 			if err != nil {
-				b.InfoLog.Printf("Download of media files of tweet with IDStr %v has failed!", tw.Id)
-				for i := 1; i <= DownloadRetries; i++ {
-					b.InfoLog.Printf("Attempt %v/%v to download media files of tweet (IDStr: %v)", i+1, DownloadRetries, tw.Id)
-					err = DownloadTo(v.MediaURL, srcPath)
-					if err == nil {
-						b.InfoLog.Printf("Media files for tweet (IDStr: %v) has succesfully downloaded", tw.Id)
-						break
-					}
-				}
-				if err != nil {
-					b.ErrLog.Printf("%v attempts to download media files for tweet with IDStr of %v has failed!", DownloadRetries)
-					return err
-				}
+				return err
 			}
-			err = capdec.Caption(srcPath, GetCaptionsForTweet(tw, quotedTweet), destFilePath, b.JSCodes)
+			err = b.Renderer.Render(srcPath, captions, destFilePath)
 			if err != nil {
 				b.ErrLog.Printf("Captioning of tweet with IDStr of %v is unsuccessful!", tw.Id)
 				b.ErrLog.Printf("Error message: %v", err)
-				panic("Exiting program...")
+				return err
 			}
 		} else {
-			err := capdec.Caption(b.HairPhotoPath, GetCaptionsForTweet(tw, quotedTweet), destFilePath, b.JSCodes)
+			footer := endNotes
+			if meta != nil {
+				if c, ok := MetadataCaption(*meta, b.Captions.Metadata); ok {
+					footer = PlainCaption(c.Text) + "\n" + footer
+				}
+			}
+			err = RenderTweetCard(tw, quotedTweet, footer, b.Card, b.Captions, destFilePath)
 			if err != nil {
-				b.ErrLog.Printf("Captioning of tweet with IDStr of %v is unsuccessful!", tw.Id)
-				b.ErrLog.Printf("Error message: %v", err)
-				panic("Exiting program...")
+				b.ErrLog.Printf("Tweet card for tweet with IDStr of %v couldn't be rendered, falling back to captioning. Error message: %v", tw.Id, err)
+				err = b.Renderer.Render(b.HairPhotoPath, captions, destFilePath)
+				if err != nil {
+					b.ErrLog.Printf("Captioning of tweet with IDStr of %v is unsuccessful!", tw.Id)
+					b.ErrLog.Printf("Error message: %v", err)
+					return err
+				}
 			}
 		}
+		b.RecordProvenance(tw, mediaPath, destFilePath)
 		b.InfoLog.Printf("Captioning of tweet with IDStr of %v has completed successfully", tw.Id)
 	}
 
-	htmlFilePath := filepath.Join(userDirPath, fNameInfo[0].LongHTMLFileName)
+	htmlFilePath := filepath.Join(rootPath, layout.Paths(tw, fNameInfo[0]).HTML)
+	b.makeDirs(htmlFilePath)
 	htmFile, err := os.OpenFile(htmlFilePath, os.O_RDWR|os.O_CREATE, 0644)
 	defer htmFile.Close()
 	if err != nil {
@@ -166,8 +252,59 @@ func (b *TweetCaptionBot) CaptionTweet(id int64, rootPath string) error {
 	return nil
 }
 
+func (b *TweetCaptionBot) layout() Layout {
+	if b.Layout == nil {
+		return PerUserLayout{}
+	}
+	return b.Layout
+}
+
+// makeDirs creates the directories of the given files.
+func (b *TweetCaptionBot) makeDirs(paths ...string) error {
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			b.ErrLog.Printf("Cannot create directory: %v! Error message: %v", dir, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchMedia saves the media file described by v to path, from LocalMedia
+// if the bot has one.
+func (b *TweetCaptionBot) fetchMedia(v TweetFileNameInfo, path string, id int64) error {
+	if b.LocalMedia != nil {
+		err := b.LocalMedia.CopyTo(path, filepath.Base(path), v.LongFileName, v.ShortFileName)
+		if err != nil {
+			b.ErrLog.Printf("Media file of tweet with IDStr of %v couldn't be copied. Error message: %v", id, err)
+		}
+		return err
+	}
+
+	err := DownloadTo(v.MediaURL, path)
+	if err != nil {
+		b.InfoLog.Printf("Download of media files of tweet with IDStr %v has failed!", id)
+		for i := 1; i <= DownloadRetries; i++ {
+			b.InfoLog.Printf("Attempt %v/%v to download media files of tweet (IDStr: %v)", i+1, DownloadRetries, id)
+			err = DownloadTo(v.MediaURL, path)
+			if err == nil {
+				b.InfoLog.Printf("Media files for tweet (IDStr: %v) has succesfully downloaded", id)
+				break
+			}
+		}
+		if err != nil {
+			b.ErrLog.Printf("%v attempts to download media files for tweet with IDStr of %v has failed!", DownloadRetries, id)
+		}
+	}
+	return err
+}
+
 func GetTweetURL(tw twigger.Tweet) string {
-	sn := tw.User.ScreenName
-	url := fmt.Sprintf("https://www.twitter.com/%v/status/%v", sn, tw.Id)
-	return url
+	return TweetURL(tw.User.ScreenName, tw.Id)
+}
+
+func TweetURL(screenName string, id int64) string {
+	return fmt.Sprintf("https://www.twitter.com/%v/status/%v", screenName, id)
 }
@@ -0,0 +1,279 @@
+package twcapbot
+
+import (
+	"golang.org/x/text/unicode/bidi"
+)
+
+// The pure Go renderer draws glyphs one by one from left to right, so text
+// has to be brought into visual order and Arabic letters into their joined
+// forms before it is drawn. The functions below implement the parts of the
+// Unicode bidirectional algorithm that matter for a single line of tweet
+// text; embeddings and overrides are ignored.
+
+// visualOrder returns line in the order its characters are displayed.
+func visualOrder(line string, rtl bool) string {
+	runes, _ := visualOrderIndex([]rune(line), rtl)
+	return string(runes)
+}
+
+// visualOrderIndex reorders runes like visualOrder. order holds the index in
+// runes of each displayed character.
+func visualOrderIndex(runes []rune, rtl bool) (visual []rune, order []int) {
+	runes = append([]rune(nil), runes...)
+	order = make([]int, len(runes))
+	for i := range order {
+		order[i] = i
+	}
+	base := 0
+	if rtl {
+		base = 1
+	}
+
+	// Resolve characters to ltr (0) or rtl (1), neutrals to -1. Numbers
+	// count as the direction of the closest letter before them.
+	classes := make([]bidi.Class, len(runes))
+	strong := make([]int, len(runes))
+	last := base
+	for i, r := range runes {
+		props, _ := bidi.LookupRune(r)
+		classes[i] = props.Class()
+		switch classes[i] {
+		case bidi.L:
+			strong[i], last = 0, 0
+		case bidi.R, bidi.AL:
+			strong[i], last = 1, 1
+		case bidi.EN:
+			strong[i] = last
+		case bidi.AN:
+			strong[i] = 1
+		default:
+			strong[i] = -1
+		}
+	}
+
+	for i := 0; i < len(runes); {
+		if strong[i] != -1 {
+			i++
+			continue
+		}
+		// Neutrals between characters of the same direction take that
+		// direction, otherwise the direction of the line.
+		j := i
+		for j < len(runes) && strong[j] == -1 {
+			j++
+		}
+		before, after := base, base
+		if i > 0 {
+			before = strong[i-1]
+		}
+		if j < len(runes) {
+			after = strong[j]
+		}
+		dir := base
+		if before == after {
+			dir = before
+		}
+		for k := i; k < j; k++ {
+			strong[k] = dir
+		}
+		i = j
+	}
+
+	// Numbers in right to left context are embedded one level deeper so
+	// that their digits keep reading left to right.
+	levels := make([]int, len(runes))
+	for i, c := range classes {
+		switch {
+		case (c == bidi.EN || c == bidi.AN) && strong[i] == 1:
+			levels[i] = 2
+		case strong[i] == base:
+			levels[i] = base
+		default:
+			levels[i] = base + 1
+		}
+	}
+
+	maxLevel := 0
+	for _, l := range levels {
+		if l > maxLevel {
+			maxLevel = l
+		}
+	}
+	for level := maxLevel; level >= 1; level-- {
+		for i := 0; i < len(runes); {
+			if levels[i] < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(runes) && levels[j] >= level {
+				j++
+			}
+			reverseRunes(runes[i:j])
+			reverseInts(levels[i:j])
+			reverseInts(order[i:j])
+			i = j
+		}
+	}
+
+	for i, r := range runes {
+		if levels[i]%2 == 1 {
+			if m, ok := mirroredRunes[r]; ok {
+				runes[i] = m
+			}
+		}
+	}
+	return runes, order
+}
+
+func reverseRunes(s []rune) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+func reverseInts(s []int) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
+
+var mirroredRunes = map[rune]rune{
+	'(': ')', ')': '(', '[': ']', ']': '[', '{': '}', '}': '{',
+	'<': '>', '>': '<', '«': '»', '»': '«', '‹': '›', '›': '‹',
+}
+
+// arabicForms lists isolated, final, initial and medial presentation forms of
+// Arabic and Persian letters. Letters that don't join the next letter have no
+// initial and medial forms.
+var arabicForms = map[rune][4]rune{
+	0x0621: {0xFE80, 0, 0, 0},
+	0x0622: {0xFE81, 0xFE82, 0, 0},
+	0x0623: {0xFE83, 0xFE84, 0, 0},
+	0x0624: {0xFE85, 0xFE86, 0, 0},
+	0x0625: {0xFE87, 0xFE88, 0, 0},
+	0x0626: {0xFE89, 0xFE8A, 0xFE8B, 0xFE8C},
+	0x0627: {0xFE8D, 0xFE8E, 0, 0},
+	0x0628: {0xFE8F, 0xFE90, 0xFE91, 0xFE92},
+	0x0629: {0xFE93, 0xFE94, 0, 0},
+	0x062A: {0xFE95, 0xFE96, 0xFE97, 0xFE98},
+	0x062B: {0xFE99, 0xFE9A, 0xFE9B, 0xFE9C},
+	0x062C: {0xFE9D, 0xFE9E, 0xFE9F, 0xFEA0},
+	0x062D: {0xFEA1, 0xFEA2, 0xFEA3, 0xFEA4},
+	0x062E: {0xFEA5, 0xFEA6, 0xFEA7, 0xFEA8},
+	0x062F: {0xFEA9, 0xFEAA, 0, 0},
+	0x0630: {0xFEAB, 0xFEAC, 0, 0},
+	0x0631: {0xFEAD, 0xFEAE, 0, 0},
+	0x0632: {0xFEAF, 0xFEB0, 0, 0},
+	0x0633: {0xFEB1, 0xFEB2, 0xFEB3, 0xFEB4},
+	0x0634: {0xFEB5, 0xFEB6, 0xFEB7, 0xFEB8},
+	0x0635: {0xFEB9, 0xFEBA, 0xFEBB, 0xFEBC},
+	0x0636: {0xFEBD, 0xFEBE, 0xFEBF, 0xFEC0},
+	0x0637: {0xFEC1, 0xFEC2, 0xFEC3, 0xFEC4},
+	0x0638: {0xFEC5, 0xFEC6, 0xFEC7, 0xFEC8},
+	0x0639: {0xFEC9, 0xFECA, 0xFECB, 0xFECC},
+	0x063A: {0xFECD, 0xFECE, 0xFECF, 0xFED0},
+	0x0640: {0x0640, 0x0640, 0x0640, 0x0640},
+	0x0641: {0xFED1, 0xFED2, 0xFED3, 0xFED4},
+	0x0642: {0xFED5, 0xFED6, 0xFED7, 0xFED8},
+	0x0643: {0xFED9, 0xFEDA, 0xFEDB, 0xFEDC},
+	0x0644: {0xFEDD, 0xFEDE, 0xFEDF, 0xFEE0},
+	0x0645: {0xFEE1, 0xFEE2, 0xFEE3, 0xFEE4},
+	0x0646: {0xFEE5, 0xFEE6, 0xFEE7, 0xFEE8},
+	0x0647: {0xFEE9, 0xFEEA, 0xFEEB, 0xFEEC},
+	0x0648: {0xFEED, 0xFEEE, 0, 0},
+	0x0649: {0xFEEF, 0xFEF0, 0, 0},
+	0x064A: {0xFEF1, 0xFEF2, 0xFEF3, 0xFEF4},
+	0x067E: {0xFB56, 0xFB57, 0xFB58, 0xFB59},
+	0x0686: {0xFB7A, 0xFB7B, 0xFB7C, 0xFB7D},
+	0x0698: {0xFB8A, 0xFB8B, 0, 0},
+	0x06A9: {0xFB8E, 0xFB8F, 0xFB90, 0xFB91},
+	0x06AF: {0xFB92, 0xFB93, 0xFB94, 0xFB95},
+	0x06CC: {0xFBFC, 0xFBFD, 0xFBFE, 0xFBFF},
+}
+
+// Isolated and final forms of lam followed by alef variants.
+var lamAlefForms = map[rune][2]rune{
+	0x0622: {0xFEF5, 0xFEF6},
+	0x0623: {0xFEF7, 0xFEF8},
+	0x0625: {0xFEF9, 0xFEFA},
+	0x0627: {0xFEFB, 0xFEFC},
+}
+
+// isArabicMark reports whether r is a diacritic that doesn't affect joining.
+func isArabicMark(r rune) bool {
+	return (r >= 0x064B && r <= 0x065F) || r == 0x0670
+}
+
+// shapeArabic replaces Arabic letters of text in logical order with their
+// contextual forms. Forms that hasGlyph rejects are left unchanged.
+func shapeArabic(text string, hasGlyph func(rune) bool) string {
+	out, _ := shapeArabicIndex([]rune(text), hasGlyph)
+	return string(out)
+}
+
+// shapeArabicIndex shapes runes like shapeArabic. src holds the index in
+// runes each shaped character comes from; a lam-alef ligature comes from its
+// lam.
+func shapeArabicIndex(runes []rune, hasGlyph func(rune) bool) (out []rune, src []int) {
+	out = make([]rune, 0, len(runes))
+	src = make([]int, 0, len(runes))
+	// neighbour returns the letter next to i in direction step, skipping
+	// diacritics.
+	neighbour := func(i, step int) rune {
+		for k := i + step; k >= 0 && k < len(runes); k += step {
+			if !isArabicMark(runes[k]) {
+				return runes[k]
+			}
+		}
+		return 0
+	}
+	joinsNext := func(r rune) bool {
+		return arabicForms[r][2] != 0
+	}
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		forms, ok := arabicForms[r]
+		if !ok {
+			out, src = append(out, r), append(src, i)
+			continue
+		}
+		prev, next := neighbour(i, -1), neighbour(i, 1)
+		joinPrev := joinsNext(prev)
+
+		if r == 0x0644 {
+			if lig, ok := lamAlefForms[next]; ok && !isArabicMark(runes[i+1]) {
+				form := lig[0]
+				if joinPrev {
+					form = lig[1]
+				}
+				if hasGlyph(form) {
+					out, src = append(out, form), append(src, i)
+					i++
+					continue
+				}
+			}
+		}
+
+		_, nextIsLetter := arabicForms[next]
+		joinNext := joinsNext(r) && nextIsLetter && next != 0x0621
+		form := forms[0]
+		switch {
+		case joinPrev && joinNext:
+			form = forms[3]
+		case joinPrev:
+			form = forms[1]
+		case joinNext:
+			form = forms[2]
+		}
+		if form == 0 {
+			form = forms[0]
+		}
+		if !hasGlyph(form) {
+			form = r
+		}
+		out, src = append(out, form), append(src, i)
+	}
+	return out, src
+}
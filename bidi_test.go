@@ -0,0 +1,114 @@
+//go:build nocapdec
+// +build nocapdec
+
+package twcapbot
+
+import (
+	"testing"
+)
+
+func allGlyphs(rune) bool { return true }
+
+func TestVisualOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		rtl  bool
+		want string
+	}{
+		{"ltr only", "hello world", false, "hello world"},
+		{"rtl only", "שלום עולם", true, "םלוע םולש"},
+		{"rtl inside ltr", "hello שלום עולם world", false, "hello םלוע םולש world"},
+		{"ltr inside rtl", "שלום hello world עולם", true, "םלוע hello world םולש"},
+		{"digits inside rtl", "שלום 2023 עולם", true, "םלוע 2023 םולש"},
+		{"digits after rtl in ltr", "price מחיר 42", false, "price 42 ריחמ"},
+		{"arabic digits", "العدد ١٢٣ هنا", true, "انه ١٢٣ ددعلا"},
+		{"url inside arabic", "انظر https://example.com/a/b هنا", true, "انه https://example.com/a/b رظنا"},
+		{"mention inside hebrew", "תודה @bob_1 על", true, "לע bob_1@ הדות"},
+		{"hashtag inside arabic", "مرحبا #golang اليوم", true, "مويلا golang# ابحرم"},
+		{"brackets are mirrored", "(שלום) [עולם]", true, "[םלוע] (םולש)"},
+		{"brackets of ltr text inside rtl", "שלום (hello) עולם", true, "םלוע (hello) םולש"},
+		{"empty", "", true, ""},
+	}
+	for _, tt := range tests {
+		if got := visualOrder(tt.line, tt.rtl); got != tt.want {
+			t.Errorf("%v: visualOrder(%q, %v) = %q, want %q", tt.name, tt.line, tt.rtl, got, tt.want)
+		}
+	}
+}
+
+func TestVisualOrderIndex(t *testing.T) {
+	runes := []rune("ab אב 12")
+	visual, order := visualOrderIndex(runes, false)
+	if string(visual) != "ab 12 בא" {
+		t.Fatalf("visualOrderIndex = %q", string(visual))
+	}
+	for i, k := range order {
+		if runes[k] != visual[i] {
+			t.Errorf("order[%v] = %v points at %q, displayed rune is %q", i, k, runes[k], visual[i])
+		}
+	}
+}
+
+func TestShapeArabic(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		// سلام: initial seen, lam-alef ligature in final form, isolated meem
+		{"lam alef ligature", "سلام", "ﺳﻼﻡ"},
+		{"isolated lam alef", "لا", "ﻻ"},
+		// Persian letters: pe, gaf, che and farsi yeh
+		{"persian pe", "پدر", "ﭘﺪﺭ"},
+		{"persian gaf", "گل", "ﮔﻞ"},
+		{"persian che", "چای", "ﭼﺎﯼ"},
+		{"persian keheh", "کتاب", "ﮐﺘﺎﺏ"},
+		// Zero width non-joiner breaks joining, as in می‌خواهم
+		{"zero width non-joiner", "می‌خواهم", "ﻣﯽ‌ﺧﻮﺍﻫﻢ"},
+		// Diacritics don't break joining
+		{"diacritics", "بَب", "ﺑَﺐ"},
+		// Hamza doesn't join
+		{"hamza", "بءب", "ﺏﺀﺏ"},
+		{"latin is unchanged", "abc 123", "abc 123"},
+		{"mixed", "@ali سلام", "@ali ﺳﻼﻡ"},
+	}
+	for _, tt := range tests {
+		if got := shapeArabic(tt.text, allGlyphs); got != tt.want {
+			t.Errorf("%v: shapeArabic(%q) = %+q, want %+q", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestShapeArabicMissingGlyphs(t *testing.T) {
+	none := func(rune) bool { return false }
+	if got := shapeArabic("سلام", none); got != "سلام" {
+		t.Errorf("shapeArabic without glyphs = %+q, want the letters unchanged", got)
+	}
+}
+
+func TestShapeArabicIndex(t *testing.T) {
+	runes := []rune("سلام")
+	out, src := shapeArabicIndex(runes, allGlyphs)
+	if len(out) != 3 {
+		t.Fatalf("shapeArabicIndex returned %+q", string(out))
+	}
+	// The ligature comes from the lam, meem from the last letter.
+	want := []int{0, 1, 3}
+	for i := range want {
+		if src[i] != want[i] {
+			t.Errorf("src = %v, want %v", src, want)
+			break
+		}
+	}
+}
+
+// Visual lines of the pure Go renderer combine shaping and reordering, so
+// Arabic is shaped in logical order first.
+func TestShapeThenOrder(t *testing.T) {
+	got := visualOrder(shapeArabic("سلام 2024", allGlyphs), true)
+	want := "2024 ﻡﻼﺳ"
+	if got != want {
+		t.Errorf("got %+q, want %+q", got, want)
+	}
+}
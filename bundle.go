@@ -0,0 +1,171 @@
+package twcapbot
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of bundles.
+const (
+	BundleZip   = "zip"
+	BundleTarGz = "tar.gz"
+
+	// BundleChecksumFile lists the SHA-256 checksums of the other files of
+	// a bundle in the format of sha256sum.
+	BundleChecksumFile = "SHA256SUMS"
+)
+
+// Extensions of files that are already compressed and are stored as they are
+// in zip bundles.
+var storedExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".mp4": true, ".zip": true, ".gz": true}
+
+// Bundle streams files into a zip or gzipped tar archive, so that a run can
+// be shared as a single file. Files are written to the archive as they are
+// added, so they can be removed right after. Closing the bundle adds the
+// checksums of its files as BundleChecksumFile. It is safe for concurrent use.
+type Bundle struct {
+	format string
+	prefix string
+
+	mu        sync.Mutex
+	zw        *zip.Writer
+	tw        *tar.Writer
+	gw        *gzip.Writer
+	names     map[string]bool
+	checksums []string
+}
+
+// BundleFormat returns the format of a bundle named after its extension,
+// .zip or .tar.gz (.tgz).
+func BundleFormat(name string) (string, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return BundleZip, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return BundleTarGz, nil
+	}
+	return "", fmt.Errorf("unknown bundle format of %v, valid extensions: .zip, .tar.gz", name)
+}
+
+// NewBundle returns a bundle writing an archive in the given format to w.
+// Names of files in the archive are prefixed with prefix, usually the name
+// of the run directory, unless it is empty.
+func NewBundle(w io.Writer, format, prefix string) (*Bundle, error) {
+	b := &Bundle{format: format, prefix: strings.Trim(filepath.ToSlash(prefix), "/"), names: map[string]bool{}}
+	switch format {
+	case BundleZip:
+		b.zw = zip.NewWriter(w)
+	case BundleTarGz:
+		b.gw = gzip.NewWriter(w)
+		b.tw = tar.NewWriter(b.gw)
+	default:
+		return nil, fmt.Errorf("unknown bundle format %q, valid values: %v, %v", format, BundleZip, BundleTarGz)
+	}
+	return b, nil
+}
+
+// AddFile adds the file at filePath to the bundle as name, a slash separated
+// path. Files added under a name already in the bundle are skipped.
+func (b *Bundle) AddFile(name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return b.add(name, info.Size(), info.ModTime(), f)
+}
+
+// AddDir adds the files under dirPath to the bundle, named after their paths
+// relative to dirPath.
+func (b *Bundle) AddDir(dirPath string) error {
+	return filepath.Walk(dirPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dirPath, p)
+		if err != nil {
+			return err
+		}
+		return b.AddFile(filepath.ToSlash(rel), p)
+	})
+}
+
+// Close adds the checksum file and finishes the archive. It doesn't close the
+// underlying writer.
+func (b *Bundle) Close() error {
+	b.mu.Lock()
+	sums := strings.Join(b.checksums, "")
+	b.mu.Unlock()
+	err := b.add(BundleChecksumFile, int64(len(sums)), time.Now(), strings.NewReader(sums))
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.zw != nil {
+		return b.zw.Close()
+	}
+	err = b.tw.Close()
+	if err != nil {
+		return err
+	}
+	return b.gw.Close()
+}
+
+func (b *Bundle) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	archiveName := name
+	if b.prefix != "" {
+		archiveName = b.prefix + "/" + name
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.names[name] {
+		return nil
+	}
+
+	var w io.Writer
+	var err error
+	if b.zw != nil {
+		h := &zip.FileHeader{Name: archiveName, Method: zip.Deflate, Modified: modTime}
+		if storedExts[strings.ToLower(path.Ext(name))] {
+			h.Method = zip.Store
+		}
+		w, err = b.zw.CreateHeader(h)
+	} else {
+		err = b.tw.WriteHeader(&tar.Header{Name: archiveName, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+		w = b.tw
+	}
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, hash), r)
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	b.names[name] = true
+	if name != BundleChecksumFile {
+		b.checksums = append(b.checksums, fmt.Sprintf("%v  %v\n", hex.EncodeToString(hash.Sum(nil)), name))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package twcapbot
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/bidi"
+	"strings"
+)
+
+const (
+	DirLTR = "ltr"
+	DirRTL = "rtl"
+)
+
+// Caption is a block of caption text. Label is an English introduction of
+// Text such as "Name (@name) tweeted:", Lang and Dir describe Text. Both
+// Label and Text are HTML fragments that may contain <br/> line breaks.
+type Caption struct {
+	Label string
+	Text  string
+	Lang  string // BCP 47 language tag, empty if unknown
+	Dir   string // DirLTR or DirRTL
+
+	// Byte ranges of the mentions and hashtags that are drawn in
+	// HighlightColor, within the plain text of Text (see PlainCaption)
+	Highlights [][]int
+}
+
+// Languages written right to left, as tagged by Twitter.
+var rtlLanguages = map[string]bool{
+	"ar": true, "arc": true, "ckb": true, "dv": true, "fa": true, "he": true,
+	"iw": true, "ps": true, "sd": true, "ug": true, "ur": true, "yi": true,
+}
+
+// TweetLanguage returns the language Twitter detected for a tweet or an
+// empty string if it couldn't detect one. Twitter tags tweets it can't
+// classify with und and tweets made of hashtags, links etc. with codes
+// starting with q.
+func TweetLanguage(lang string) string {
+	if lang == "und" || lang == "zxx" || strings.HasPrefix(lang, "q") {
+		return ""
+	}
+	return lang
+}
+
+// TextDirection returns the direction text in the given language is written
+// in. If the language is unknown, the first strongly directional character
+// of text decides.
+func TextDirection(text, lang string) string {
+	if lang = TweetLanguage(lang); lang != "" {
+		base := strings.ToLower(strings.SplitN(lang, "-", 2)[0])
+		if rtlLanguages[base] {
+			return DirRTL
+		}
+		return DirLTR
+	}
+	for _, r := range text {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.L:
+			return DirLTR
+		case bidi.R, bidi.AL:
+			return DirRTL
+		}
+	}
+	return DirLTR
+}
+
+// NewTextCaption returns a caption for plain text in the given language.
+// label is an HTML fragment.
+func NewTextCaption(label, text, lang string) Caption {
+	return Caption{
+		Label: label,
+		Text:  EscapeCaptionText(text),
+		Lang:  TweetLanguage(lang),
+		Dir:   TextDirection(text, lang),
+	}
+}
+
+// NewNoteCaption returns a caption for notes written by the bot.
+func NewNoteCaption(text string) Caption {
+	return Caption{Text: text, Lang: "en", Dir: DirLTR}
+}
+
+// HTML returns the caption as an HTML fragment for capdec. Right-to-left text
+// is placed below its label so that the label keeps reading left to right.
+func (c Caption) HTML() string {
+	dir := c.Dir
+	if dir == "" {
+		dir = "auto"
+	}
+	attrs := fmt.Sprintf(` dir="%v"`, dir)
+	if c.Lang != "" {
+		attrs += fmt.Sprintf(` lang="%v"`, c.Lang)
+	}
+
+	if c.Label == "" {
+		return fmt.Sprintf("<div%v>%v</div>", attrs, c.Text)
+	}
+	if c.Dir == DirRTL {
+		return fmt.Sprintf(`<div dir="ltr" lang="en">%v</div><div%v>%v</div>`, c.Label, attrs, c.Text)
+	}
+	return fmt.Sprintf(`<div dir="ltr" lang="en">%v <span%v>%v</span></div>`, c.Label, attrs, c.Text)
+}
@@ -0,0 +1,176 @@
+//go:build nocapdec
+// +build nocapdec
+
+package twcapbot
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/gusanmaz/twigger"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Rewrite golden files of tests")
+
+func TestCaptionHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		caption Caption
+		want    string
+	}{
+		{
+			"ltr text follows its label",
+			NewTextCaption("Alice (@alice) tweeted:", "Hello world", "en"),
+			`<div dir="ltr" lang="en">Alice (@alice) tweeted: <span dir="ltr" lang="en">Hello world</span></div>`,
+		},
+		{
+			"rtl text goes below its label",
+			NewTextCaption("Dana (@dana) tweeted:", "שלום עולם", "he"),
+			`<div dir="ltr" lang="en">Dana (@dana) tweeted:</div><div dir="rtl" lang="he">שלום עולם</div>`,
+		},
+		{
+			"rtl language of ltr looking text",
+			NewTextCaption("Ali (@ali) tweeted:", "2024 https://example.com", "ar"),
+			`<div dir="ltr" lang="en">Ali (@ali) tweeted:</div><div dir="rtl" lang="ar">2024 https://example.com</div>`,
+		},
+		{
+			"unknown language takes the direction of the text",
+			NewTextCaption("", "سلام دنیا", "und"),
+			`<div dir="rtl">سلام دنیا</div>`,
+		},
+		{
+			"ltr text of unknown language",
+			NewTextCaption("", "#hashtag שלום", "qht"),
+			`<div dir="ltr">#hashtag שלום</div>`,
+		},
+		{
+			"text is escaped",
+			NewTextCaption("", "a < b & c\nשלום", "en"),
+			`<div dir="ltr" lang="en">a &lt; b &amp; c<br/>שלום</div>`,
+		},
+		{
+			"note",
+			NewNoteCaption("URL: https://twitter.com/a/status/1"),
+			`<div dir="ltr" lang="en">URL: https://twitter.com/a/status/1</div>`,
+		},
+		{
+			"missing direction",
+			Caption{Text: "text"},
+			`<div dir="auto">text</div>`,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.caption.HTML(); got != tt.want {
+			t.Errorf("%v:\n got %v\nwant %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStyledTextCaptionHighlights(t *testing.T) {
+	text := "שלום @bob ו-@bobby #go"
+	c := NewStyledTextCaption("", text, "he", map[string]bool{"@bob": true, "#go": true})
+	plain := PlainCaption(c.Text)
+	got := []string{}
+	for _, r := range c.Highlights {
+		got = append(got, plain[r[0]:r[1]])
+	}
+	if strings.Join(got, " ") != "@bob #go" {
+		t.Errorf("highlights = %q, want @bob and #go only", got)
+	}
+	want := `<div dir="rtl" lang="he">שלום <span style="color:#1d9bf0">@bob</span> ו-@bobby <span style="color:#1d9bf0">#go</span></div>`
+	if html := c.HTML(); html != want {
+		t.Errorf("HTML:\n got %v\nwant %v", html, want)
+	}
+}
+
+// Tweets of the golden tests of GetCaptionsForTweet, the name of each is the
+// name of its golden file in testdata/captions.
+var captionTweets = []struct {
+	name   string
+	tweet  string
+	quoted string
+	opts   CaptionOptions
+}{
+	{
+		name: "hebrew",
+		tweet: `{"id": 1, "lang": "he", "full_text": "שלום @bob, ראו https://t.co/abc ב-2024",
+			"user": {"id": 10, "name": "דנה", "screen_name": "dana"},
+			"entities": {"urls": [{"url": "https://t.co/abc", "display_url": "example.com/a", "expanded_url": "https://example.com/a"}],
+				"user_mentions": [{"screen_name": "bob"}]}}`,
+	},
+	{
+		name: "arabic_styled",
+		tweet: `{"id": 2, "lang": "ar", "full_text": "مرحبا @bob و @bobby #يوم_جميل",
+			"user": {"id": 11, "name": "علي", "screen_name": "ali"},
+			"entities": {"user_mentions": [{"screen_name": "bob"}], "hashtags": [{"text": "يوم_جميل"}]}}`,
+		opts: CaptionOptions{StyleEntities: true},
+	},
+	{
+		name: "english_with_hebrew",
+		tweet: `{"id": 3, "lang": "en", "full_text": "The word שלום means peace &amp; hello",
+			"user": {"id": 12, "name": "Alice", "screen_name": "alice"}}`,
+	},
+	{
+		name: "persian_unknown_language",
+		tweet: `{"id": 4, "lang": "und", "full_text": "می‌خواهم ۱۴۰۲",
+			"user": {"id": 13, "name": "Sara", "screen_name": "sara"}}`,
+	},
+	{
+		name: "url_query_entities",
+		tweet: `{"id": 7, "lang": "en", "full_text": "Fish &amp; chips https://t.co/q",
+			"user": {"id": 12, "name": "Alice", "screen_name": "alice"},
+			"entities": {"urls": [{"url": "https://t.co/q", "display_url": "example.com/s?lang=en&reg…", "expanded_url": "https://example.com/s?lang=en&region=us&copy=1&notify=0"}]}}`,
+		opts: CaptionOptions{FullURLs: true},
+	},
+	{
+		name: "arabic_quotes_english",
+		tweet: `{"id": 5, "lang": "ar", "full_text": "انظر هذا https://t.co/xyz",
+			"user": {"id": 11, "name": "علي", "screen_name": "ali"},
+			"entities": {"urls": [{"url": "https://t.co/xyz", "display_url": "example.org/long…", "expanded_url": "https://example.org/long/path"}]}}`,
+		quoted: `{"id": 6, "lang": "en", "full_text": "Go 1.16 is out",
+			"user": {"id": 12, "name": "Alice", "screen_name": "alice"}}`,
+		opts: CaptionOptions{FullURLs: true},
+	},
+}
+
+func TestGetCaptionsForTweetGolden(t *testing.T) {
+	SetBotScreenName("capbot")
+	for _, tt := range captionTweets {
+		var tw twigger.Tweet
+		if err := json.Unmarshal([]byte(tt.tweet), &tw); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		var quoted *twigger.Tweet
+		if tt.quoted != "" {
+			quoted = &twigger.Tweet{}
+			if err := json.Unmarshal([]byte(tt.quoted), quoted); err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+		}
+
+		var b strings.Builder
+		for _, c := range GetCaptionsForTweet(tw, quoted, tt.opts, nil) {
+			b.WriteString(c.HTML())
+			b.WriteString("\n")
+		}
+		got := b.String()
+
+		path := filepath.Join("testdata", "captions", tt.name+".html")
+		if *update {
+			if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v: %v, run go test -update to create it", tt.name, err)
+		}
+		if got != string(want) {
+			t.Errorf("%v: captions differ from %v\n got:\n%v\nwant:\n%v", tt.name, path, got, want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CardOptions configures rendering of text-only tweets as tweet cards.
+type CardOptions struct {
+	Width     int
+	MinHeight int
+	Padding   int
+	FontSize  float64
+
+	Background color.Color
+	Foreground color.Color
+	Secondary  color.Color // Handle, timestamp and footer
+	Border     color.Color // Border of quoted tweets
+	Highlight  color.Color // Mentions and hashtags of styled captions
+
+	AvatarSize int  // 0 disables avatars
+	NoAvatars  bool // Don't download avatars, draw initials instead
+
+	// Empty font paths select the Go fonts. Fallback fonts are used for
+	// glyphs the main fonts lack, e.g. a monochrome emoji or a CJK font.
+	// DefaultCardOptions sets them to SystemFallbackFonts. Color emoji
+	// fonts can't be drawn, emoji missing from every font show as boxes.
+	FontPath          string
+	BoldFontPath      string
+	FallbackFontPaths []string
+
+	TimeLayout string
+	Location   *time.Location
+}
+
+func DefaultCardOptions() CardOptions {
+	return CardOptions{
+		Width:      1000,
+		MinHeight:  300,
+		Padding:    40,
+		FontSize:   30,
+		Background: color.White,
+		Foreground: color.RGBA{0x0f, 0x14, 0x19, 0xff},
+		Secondary:  color.RGBA{0x53, 0x64, 0x71, 0xff},
+		Border:     color.RGBA{0xcf, 0xd9, 0xde, 0xff},
+		Highlight:  color.RGBA{0x1d, 0x9b, 0xf0, 0xff},
+		AvatarSize: 96,
+		TimeLayout: "3:04 PM · Jan 2, 2006",
+		Location:   time.Local,
+
+		FallbackFontPaths: SystemFallbackFonts(),
+	}
+}
+
+// ParseColor parses a color in #rrggbb or #rgb notation.
+func ParseColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	var r, g, b uint8
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid color %q, colors are written as #rrggbb", s)
+	}
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x", &r, &g, &b); err != nil {
+		return nil, fmt.Errorf("invalid color %q, colors are written as #rrggbb", s)
+	}
+	return color.RGBA{r, g, b, 0xff}, nil
+}
+
+// minCardWidth leaves room for a line of text next to the avatar.
+const minCardWidth = 400
+
+// SetAppearance sets the width and colors of cards, empty colors are left
+// as they are.
+func (o *CardOptions) SetAppearance(width int, background, foreground, highlight string) error {
+	if width < minCardWidth {
+		return fmt.Errorf("card width %v is less than %v", width, minCardWidth)
+	}
+	o.Width = width
+	for _, c := range []struct {
+		value string
+		dest  *color.Color
+	}{{background, &o.Background}, {foreground, &o.Foreground}, {highlight, &o.Highlight}} {
+		if c.value == "" {
+			continue
+		}
+		col, err := ParseColor(c.value)
+		if err != nil {
+			return err
+		}
+		*c.dest = col
+	}
+	return nil
+}
+
+// card is the set of faces a tweet card is drawn with.
+type card struct {
+	opts      CardOptions
+	captions  CaptionOptions
+	regular   *textFace
+	bold      *textFace
+	small     *textFace
+	avatarFor func(tw twigger.Tweet, size int) image.Image
+}
+
+// RenderTweetCard renders a text-only tweet, and the tweet it quotes if any,
+// as a PNG image at destPath. footer is printed in small letters at the bottom.
+// Tweet texts follow captions the way caption texts do: URLs are expanded if
+// FullURLs is set and mentions and hashtags are highlighted if StyleEntities
+// is set.
+func RenderTweetCard(tw twigger.Tweet, quotedTweet *twigger.Tweet, footer string, opts CardOptions, captions CaptionOptions, destPath string) error {
+	c, err := newCard(opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.captions = captions
+
+	height := c.layout(nil, tw, quotedTweet, footer)
+	if height < opts.MinHeight {
+		height = opts.MinHeight
+	}
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(opts.Background), image.Point{}, draw.Src)
+	c.layout(img, tw, quotedTweet, footer)
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func newCard(opts CardOptions) (*card, error) {
+	boldPath := opts.BoldFontPath
+	if boldPath == "" && opts.FontPath == "" {
+		boldPath = builtinBold
+	} else if boldPath == "" {
+		boldPath = opts.FontPath
+	}
+
+	c := &card{opts: opts, avatarFor: downloadAvatar}
+	if opts.NoAvatars {
+		c.avatarFor = func(twigger.Tweet, int) image.Image { return nil }
+	}
+	var err error
+	c.regular, err = newTextFace(opts.FontSize, append([]string{opts.FontPath}, opts.FallbackFontPaths...)...)
+	if err != nil {
+		return nil, err
+	}
+	c.bold, err = newTextFace(opts.FontSize, append([]string{boldPath}, opts.FallbackFontPaths...)...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.small, err = newTextFace(opts.FontSize*0.7, append([]string{opts.FontPath}, opts.FallbackFontPaths...)...)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *card) Close() {
+	for _, t := range []*textFace{c.regular, c.bold, c.small} {
+		if t != nil {
+			t.Close()
+		}
+	}
+}
+
+// layout draws the card on img and returns its height. A nil img only
+// measures the card.
+func (c *card) layout(img draw.Image, tw twigger.Tweet, quotedTweet *twigger.Tweet, footer string) int {
+	o := c.opts
+	x := o.Padding
+	width := o.Width - 2*o.Padding
+
+	y := c.layoutTweet(img, tw, x, o.Padding, width, o.AvatarSize)
+
+	if quotedTweet != nil {
+		inner := o.Padding / 2
+		top := y
+		y = c.layoutTweet(img, *quotedTweet, x+inner, y+inner, width-2*inner, o.AvatarSize/2)
+		y += inner
+		if img != nil {
+			drawRectOutline(img, image.Rect(x, top, x+width, y), o.Border, 2)
+		}
+		y += c.regular.lineHeight() / 2
+	}
+
+	if t, err := time.Parse(time.RubyDate, tw.CreatedAt); err == nil {
+		loc := o.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		y = c.drawLines(img, c.small, []string{t.In(loc).Format(o.TimeLayout)}, x, y, o.Secondary)
+	}
+	y = c.drawLines(img, c.small, c.small.wrap(GetTweetURL(tw), width), x, y, o.Secondary)
+	if footer != "" {
+		y += c.small.lineHeight() / 2
+		y = c.drawLines(img, c.small, c.small.wrap(footer, width), x, y, o.Secondary)
+	}
+	return y + o.Padding
+}
+
+// layoutTweet draws the header and text of a tweet within the column starting
+// at x and returns the y coordinate below it.
+func (c *card) layoutTweet(img draw.Image, tw twigger.Tweet, x, y, width, avatarSize int) int {
+	o := c.opts
+	headerX := x
+	headerHeight := c.bold.lineHeight() + c.regular.lineHeight()
+	if avatarSize > 0 {
+		if img != nil {
+			avatar := c.avatarFor(tw, avatarSize)
+			if avatar == nil {
+				avatar = initialsAvatar(tw.User.Name, avatarSize, o.Secondary, o.Background, c.bold)
+			}
+			drawCircle(img, avatar, image.Pt(x, y))
+		}
+		headerX += avatarSize + o.Padding/2
+		if avatarSize > headerHeight {
+			headerHeight = avatarSize
+		}
+	}
+
+	headerWidth := width - (headerX - x)
+	hy := y
+	hy = c.drawLines(img, c.bold, c.bold.wrap(tw.User.Name, headerWidth)[:1], headerX, hy, o.Foreground)
+	c.drawLines(img, c.regular, []string{"@" + tw.User.ScreenName}, headerX, hy, o.Secondary)
+
+	y += headerHeight + c.regular.lineHeight()/2
+	text := ExpandTweetText(tw, c.captions.FullURLs)
+	rtl := TextDirection(text, tw.Lang) == DirRTL
+	var ranges [][]int
+	if c.captions.StyleEntities && o.Highlight != nil {
+		ranges = findEntities(text, EntityTokens(tw))
+	}
+	runes, marked := []rune(text), markRanges(text, ranges)
+	for _, span := range c.regular.wrapRunes(runes, width) {
+		if img != nil {
+			visual, vmarked := c.regular.visualMarked(string(runes[span[0]:span[1]]), marked[span[0]:span[1]], rtl)
+			lx := x
+			if rtl {
+				lx = x + width - c.regular.measure(visual)
+			}
+			c.regular.drawHighlighted(img, lx, y+c.regular.ascent(), visual, o.Foreground, o.Highlight, vmarked)
+		}
+		y += c.regular.lineHeight()
+	}
+	return y + c.regular.lineHeight()/2
+}
+
+// drawLines draws left-to-right lines top to bottom starting at y and returns
+// the y coordinate below the last line.
+func (c *card) drawLines(img draw.Image, face *textFace, lines []string, x, y int, col color.Color) int {
+	for _, line := range lines {
+		if img != nil {
+			face.draw(img, x, y+face.ascent(), face.visual(line, false), col)
+		}
+		y += face.lineHeight()
+	}
+	return y
+}
+
+// downloadAvatar returns the profile image of the tweet's author or nil if it
+// cannot be retrieved.
+func downloadAvatar(tw twigger.Tweet, size int) image.Image {
+	u := tw.User.ProfileImageUrlHttps
+	if u == "" {
+		return nil
+	}
+	// Twitter serves 48px images by default, _bigger is 73px and no suffix
+	// is the original upload.
+	u = strings.Replace(u, "_normal.", ".", 1)
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil
+	}
+	b := img.Bounds()
+	return ScaleImage(img, float64(size)/float64(maxInt(b.Dx(), b.Dy())))
+}
+
+func initialsAvatar(name string, size int, bg, fg color.Color, face *textFace) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	r, _ := utf8.DecodeRuneInString(strings.TrimSpace(name))
+	if r == utf8.RuneError {
+		return img
+	}
+	initial := strings.ToUpper(string(r))
+	w := face.measure(initial)
+	face.draw(img, (size-w)/2, (size+face.ascent())/2-2, initial, fg)
+	return img
+}
+
+// drawCircle draws src clipped to the circle inscribed in its bounds at pt.
+func drawCircle(dst draw.Image, src image.Image, pt image.Point) {
+	b := src.Bounds()
+	size := maxInt(b.Dx(), b.Dy())
+	mask := image.NewAlpha(image.Rect(0, 0, size, size))
+	r := float64(size) / 2
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			dx, dy := float64(px)+0.5-r, float64(py)+0.5-r
+			if dx*dx+dy*dy <= r*r {
+				mask.SetAlpha(px, py, color.Alpha{A: 0xff})
+			}
+		}
+	}
+	rect := image.Rectangle{Min: pt, Max: pt.Add(image.Pt(size, size))}
+	draw.DrawMask(dst, rect, src, b.Min, mask, image.Point{}, draw.Over)
+}
+
+func drawRectOutline(dst draw.Image, r image.Rectangle, col color.Color, thickness int) {
+	src := image.NewUniform(col)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y), src, image.Point{}, draw.Src)
+	draw.Draw(dst, image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y), src, image.Point{}, draw.Src)
+}
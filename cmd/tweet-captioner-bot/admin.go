@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ReadyWindow is the longest time since the last successful mention retrieval
+// for which the bot is still reported as ready.
+const ReadyWindow = 5 * MentionQueryPause
+
+var (
+	pollingPaused int32
+	lastPollTime  int64
+)
+
+type taskView struct {
+	IDStr       string      `json:"id"`
+	Time        int64       `json:"time"`
+	User        string      `json:"user"`
+	Target      int64       `json:"target"`
+	Text        string      `json:"text"`
+	Manual      bool        `json:"manual"`
+	NextAttempt int64       `json:"nextAttempt,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Failures    []FailEvent `json:"failures"`
+}
+
+type adminServer struct {
+	bot *twcapbot.TweetCaptionBot
+}
+
+func (e FailEvent) MarshalJSON() ([]byte, error) {
+	errText := ""
+	if e.Error != nil {
+		errText = e.Error.Error()
+	}
+	return json.Marshal(struct {
+		Retry int    `json:"retry"`
+		Time  int64  `json:"time"`
+		Error string `json:"error"`
+	}{e.Retry, e.Time, errText})
+}
+
+func IsPollingPaused() bool {
+	return atomic.LoadInt32(&pollingPaused) == 1
+}
+
+func SetPollingPaused(paused bool) {
+	val := int32(0)
+	if paused {
+		val = 1
+	}
+	atomic.StoreInt32(&pollingPaused, val)
+}
+
+func StartAdminServer(bot *twcapbot.TweetCaptionBot, addr string) {
+	s := adminServer{bot: bot}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/tasks", s.handleTasks)
+	mux.HandleFunc("/tasks/retry", s.handleRetry)
+	mux.HandleFunc("/tasks/drop", s.handleDrop)
+	mux.HandleFunc("/tasks/enqueue", s.handleEnqueue)
+	mux.HandleFunc("/deadletters", s.handleDeadLetters)
+	mux.HandleFunc("/deadletters/requeue", s.handleRequeue)
+	mux.HandleFunc("/pause", s.handlePause)
+	mux.HandleFunc("/resume", s.handleResume)
+
+	go func() {
+		bot.InfoLog.Printf("Admin server is listening on %v", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			bot.ErrLog.Printf("Admin server has stopped! Error message: %v", err)
+		}
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "%v requires POST", r.URL.Path)
+		return false
+	}
+	return true
+}
+
+func (s adminServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s adminServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if s.bot.TwiggerConn.User == nil {
+		writeError(w, http.StatusServiceUnavailable, "Twitter connection is not established")
+		return
+	}
+	last := atomic.LoadInt64(&lastPollTime)
+	since := time.Since(time.Unix(last, 0))
+	if !IsPollingPaused() && last == 0 {
+		writeError(w, http.StatusServiceUnavailable, "mentions are not polled yet")
+		return
+	}
+	if !IsPollingPaused() && since > ReadyWindow {
+		writeError(w, http.StatusServiceUnavailable, "last successful mention retrieval was %v ago", since.Round(time.Second))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "ready",
+		"paused":   IsPollingPaused(),
+		"lastPoll": last,
+	})
+}
+
+func taskViews(tasks *SafeTasks) []taskView {
+	tasks.mu.Lock()
+	views := make([]taskView, 0, len(tasks.Tasks))
+	for _, m := range tasks.Tasks {
+		views = append(views, taskView{
+			IDStr:       m.IDStr,
+			Time:        m.Time,
+			User:        m.Tweet.User.ScreenName,
+			Target:      m.Tweet.InReplyToStatusID,
+			Text:        m.Tweet.FullText,
+			Manual:      m.Manual,
+			NextAttempt: m.NextAttempt,
+			Reason:      m.Reason,
+			Failures:    m.Failures,
+		})
+	}
+	tasks.mu.Unlock()
+
+	sort.Slice(views, func(i, j int) bool { return views[i].Time < views[j].Time })
+	return views
+}
+
+func (s adminServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused": IsPollingPaused(),
+		"tasks":  taskViews(&Tasks),
+	})
+}
+
+func (s adminServer) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deadLetters": taskViews(&DeadLetters),
+	})
+}
+
+func (s adminServer) handleRequeue(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if !Requeue(id) {
+		writeError(w, http.StatusNotFound, "there is no dead letter with ID %v", id)
+		return
+	}
+	s.bot.InfoLog.Printf("Dead letter %v has been requeued through the admin server", id)
+	writeJSON(w, http.StatusOK, map[string]string{"requeued": id})
+}
+
+func (s adminServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	SetPollingPaused(true)
+	s.bot.InfoLog.Println("Mention polling has been paused through the admin server")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (s adminServer) handleResume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	SetPollingPaused(false)
+	s.bot.InfoLog.Println("Mention polling has been resumed through the admin server")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (s adminServer) handleRetry(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	Tasks.mu.Lock()
+	m, ok := Tasks.Tasks[id]
+	if ok {
+		m.Failures = []FailEvent{}
+		m.Time = time.Now().Unix()
+		m.NextAttempt = 0
+		Tasks.Tasks[id] = m
+	}
+	Tasks.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "there is no pending task with ID %v", id)
+		return
+	}
+	s.bot.InfoLog.Printf("Task %v has been rescheduled through the admin server", id)
+	writeJSON(w, http.StatusOK, map[string]string{"retried": id})
+}
+
+func (s adminServer) handleDrop(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	Tasks.mu.Lock()
+	_, ok := Tasks.Tasks[id]
+	delete(Tasks.Tasks, id)
+	Tasks.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "there is no pending task with ID %v", id)
+		return
+	}
+	s.bot.InfoLog.Printf("Task %v has been dropped through the admin server", id)
+	writeJSON(w, http.StatusOK, map[string]string{"dropped": id})
+}
+
+// handleEnqueue schedules captioning of an arbitrary tweet. As there is no
+// mention to answer, the caption is published as a reply to the tweet itself.
+func (s adminServer) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	idStr := r.URL.Query().Get("tweet")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		writeError(w, http.StatusBadRequest, "%q is not a valid tweet ID", idStr)
+		return
+	}
+
+	target, err := s.bot.TwiggerConn.GetSingleTweetFromID(id)
+	if err != nil || target.Id == 0 {
+		writeError(w, http.StatusNotFound, "tweet %v cannot be retrieved", id)
+		return
+	}
+
+	mention := twigger.Tweet{
+		Id:                target.Id,
+		IdStr:             target.IdStr,
+		InReplyToStatusID: target.Id,
+		User:              target.User,
+		CreatedAt:         time.Now().Format(time.RubyDate),
+	}
+
+	Tasks.mu.Lock()
+	Tasks.Tasks[mention.IdStr] = Mention{
+		IDStr:    mention.IdStr,
+		ID:       mention.Id,
+		Time:     time.Now().Unix(),
+		Tweet:    mention,
+		Failures: []FailEvent{},
+		Manual:   true,
+	}
+	Tasks.mu.Unlock()
+
+	s.bot.InfoLog.Printf("Tweet %v has been enqueued for captioning through the admin server", id)
+	writeJSON(w, http.StatusAccepted, map[string]string{"enqueued": mention.IdStr})
+}
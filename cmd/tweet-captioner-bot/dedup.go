@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	cooldownDef   = time.Hour
+	cooldownUsage = "Mentions of an already captioned tweet within this duration are answered with a link to the earlier reply"
+
+	LinkResponseText = "Your captioned tweet is ready:"
+)
+
+// TargetReply is the caption reply published for a target tweet.
+type TargetReply struct {
+	ReplyID int64
+	Time    int64
+}
+
+var (
+	cooldownFlag time.Duration
+	targets      = map[int64]TargetReply{}
+	targetsMu    sync.Mutex
+)
+
+// RecentReply returns the caption reply for the target tweet if it has been
+// published within the cooldown.
+func RecentReply(target int64) (TargetReply, bool) {
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	now := time.Now()
+	for id, reply := range targets {
+		if now.Sub(time.Unix(reply.Time, 0)) > cooldownFlag {
+			delete(targets, id)
+		}
+	}
+	reply, ok := targets[target]
+	return reply, ok
+}
+
+func RememberReply(target, replyID int64) {
+	targetsMu.Lock()
+	targets[target] = TargetReply{ReplyID: replyID, Time: time.Now().Unix()}
+	targetsMu.Unlock()
+}
+
+// TasksForTarget returns keys of pending tasks asking for the same target
+// tweet, oldest first.
+func TasksForTarget(target int64) []string {
+	Tasks.mu.Lock()
+	defer Tasks.mu.Unlock()
+	keys := []string{}
+	for k, v := range Tasks.Tasks {
+		if v.Tweet.InReplyToStatusID == target {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, tj := Tasks.Tasks[keys[i]].Time, Tasks.Tasks[keys[j]].Time
+		if ti != tj {
+			return ti < tj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// ReplyWithLink answers the pending task with a link to the caption reply that
+// is already published for its target tweet instead of rendering it again.
+func ReplyWithLink(bot *twcapbot.TweetCaptionBot, key string, reply TargetReply) {
+	Tasks.mu.Lock()
+	m, ok := Tasks.Tasks[key]
+	Tasks.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	replyURL := twcapbot.TweetURL(bot.TwiggerConn.User.ScreenName, reply.ReplyID)
+	text := fmt.Sprintf("@%v %v %v", m.Tweet.User.ScreenName, LinkResponseText, replyURL)
+	replyID, err := bot.PublishTextReply(text, m.Tweet.Id)
+	if err != nil {
+		RecordFailure(bot, key, err)
+		return
+	}
+	bot.InfoLog.Printf("Mention %v has been answered with a link to earlier caption reply %v", m.IDStr, reply.ReplyID)
+	FinishTask(bot, key, NewTaskRecord(m, TaskCompleted, "", replyID))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	historyFileName = "tasks.jsonl"
+
+	TaskCompleted = "completed"
+	TaskFailed    = "failed"
+	TaskRejected  = "rejected" // Mention is not admitted because of access lists, loops or quotas
+)
+
+// TaskRecord is a single line of the task history file. Every finished task,
+// successful or not, is recorded exactly once.
+type TaskRecord struct {
+	Status      string    `json:"status"`
+	MentionID   string    `json:"mentionID"`
+	RequesterID string    `json:"requesterID"`
+	Requester   string    `json:"requester"`
+	TargetTweet int64     `json:"targetTweet"`
+	ReplyID     int64     `json:"replyID,omitempty"`
+	Manual      bool      `json:"manual,omitempty"`
+	Attempts    int       `json:"attempts"`
+	Reason      string    `json:"reason,omitempty"`
+	Errors      []string  `json:"errors,omitempty"`
+	RequestedAt time.Time `json:"requestedAt"`
+	FinishedAt  time.Time `json:"finishedAt"`
+	LatencyMs   int64     `json:"latencyMs"`
+}
+
+var (
+	HistoryPath string
+	historyMu   sync.Mutex
+)
+
+// NewTaskRecord records the outcome of the task of m, replyID is 0 for tasks
+// without a reply.
+func NewTaskRecord(m Mention, status, reason string, replyID int64) TaskRecord {
+	now := time.Now()
+	requested := time.Unix(m.Time, 0)
+	attempts := len(m.Failures)
+	if status == TaskCompleted {
+		attempts++
+	}
+	errs := make([]string, 0, len(m.Failures))
+	for _, failure := range m.Failures {
+		if failure.Error != nil {
+			errs = append(errs, failure.Error.Error())
+		}
+	}
+	return TaskRecord{
+		Status:      status,
+		MentionID:   m.IDStr,
+		RequesterID: m.Tweet.User.IdStr,
+		Requester:   m.Tweet.User.ScreenName,
+		TargetTweet: m.Tweet.InReplyToStatusID,
+		ReplyID:     replyID,
+		Manual:      m.Manual,
+		Attempts:    attempts,
+		Reason:      reason,
+		Errors:      errs,
+		RequestedAt: requested.UTC(),
+		FinishedAt:  now.UTC(),
+		LatencyMs:   now.Sub(requested).Milliseconds(),
+	}
+}
+
+func AppendToHistory(rec TaskRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	f, err := os.OpenFile(HistoryPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// LoadHistory reads task records whose finish time falls into [since, until).
+// Zero since or until values leave that side of the range open.
+func LoadHistory(path string, since, until time.Time) ([]TaskRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []TaskRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		rec := TaskRecord{}
+		err := json.Unmarshal(line, &rec)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, lineNo, err)
+		}
+		if !since.IsZero() && rec.FinishedAt.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !rec.FinishedAt.Before(until) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"regexp"
+)
+
+const (
+	optOutFileName = "optout.list"
+	optOutUsage    = "File listing users who opted out of captioning. Defaults to optout.list inside the output directory"
+
+	OptOutResponseTempl = "@%v You have opted out. Your tweets won't be captioned anymore and %v files generated from them have been deleted."
+)
+
+var (
+	optOutFlag  string
+	optOutRegex = regexp.MustCompile(`\bopt[\s-]?out\b`)
+)
+
+// IsOptOutRequest expects lower-cased mention text.
+func IsOptOutRequest(text string) bool {
+	return optOutRegex.MatchString(text)
+}
+
+// OptOut adds the author of the mention to the opt-out list, deletes files
+// generated from their tweets. Pending tasks for their tweets fail on their
+// own as the tweets are checked against the list before captioning.
+func OptOut(bot *twcapbot.TweetCaptionBot, mention twigger.Tweet) {
+	user := mention.User
+	err := bot.OptOuts.Add(user.IdStr, user.ScreenName)
+	if err != nil {
+		bot.ErrLog.Printf("@%v couldn't be added to the opt-out list. Error message: %v", user.ScreenName, err)
+		return
+	}
+	bot.InfoLog.Printf("@%v (ID: %v) has opted out", user.ScreenName, user.IdStr)
+
+	removed, err := bot.PurgeUserFiles(user.Id)
+	if err != nil {
+		bot.ErrLog.Printf("Files of @%v couldn't be purged. Error message: %v", user.ScreenName, err)
+	}
+
+	text := fmt.Sprintf(OptOutResponseTempl, user.ScreenName, len(removed))
+	_, err = bot.PublishTextReply(text, mention.Id)
+	if err != nil {
+		bot.ErrLog.Printf("Opt-out confirmation to @%v couldn't be published. Error message: %v", user.ScreenName, err)
+	}
+}
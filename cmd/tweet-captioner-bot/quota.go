@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userQuotaDef     = 5
+	userQuotaUsage   = "Maximum number of caption requests accepted from a single user within the quota window. 0 disables the limit"
+	globalQuotaDef   = 60
+	globalQuotaUsage = "Maximum number of caption requests accepted from all users within the quota window. 0 disables the limit"
+	quotaWindowDef   = time.Hour
+	quotaWindowUsage = "Length of the sliding window that quotas are applied on"
+	blocklistUsage   = "File listing screen names or user IDs, one per line, whose mentions are ignored"
+	allowlistUsage   = "File listing screen names or user IDs, one per line. If given, mentions of everyone else are ignored"
+	allowSelfUsage   = "Accept mentions published by the bot account itself and replies to its tweets, for testing with a single account"
+
+	LoopBurst       = 4 // Replies to the bot from one user within LoopWindow that are taken as a bot loop
+	LoopWindow      = 2 * time.Minute
+	LoopBlockPeriod = 6 * time.Hour // How long a user detected in a loop is ignored
+
+	QuotaNoticeTempl = "@%v You have reached the limit of %v caption requests per %v. Please try again later."
+)
+
+var (
+	userQuotaFlag   int
+	globalQuotaFlag int
+	quotaWindowFlag time.Duration
+	blocklistFlag   string
+	allowlistFlag   string
+	allowSelfFlag   bool
+)
+
+// UserList is a set of lower-cased screen names and user IDs.
+type UserList map[string]bool
+
+// LoadUserList reads a file listing one screen name (with or without @) or
+// numeric user ID per line. Empty lines and lines starting with # are skipped.
+func LoadUserList(path string) (UserList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list := UserList{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(strings.TrimPrefix(line, "@"))] = true
+	}
+	return list, scanner.Err()
+}
+
+func (l UserList) Contains(idStr, screenName string) bool {
+	return l[idStr] || l[strings.ToLower(screenName)]
+}
+
+// Gatekeeper decides which mentions are turned into tasks.
+type Gatekeeper struct {
+	UserLimit   int
+	GlobalLimit int
+	Window      time.Duration
+	Blocklist   UserList
+	Allowlist   UserList // nil allows everyone
+	AllowSelf   bool     // Accept mentions of the bot account itself and replies to it, used when testing
+
+	mu           sync.Mutex
+	userRequests map[string][]time.Time
+	allRequests  []time.Time
+	notified     map[string]time.Time
+	recent       map[string][]time.Time
+	loopBlocked  map[string]time.Time
+}
+
+func NewGatekeeper(userLimit, globalLimit int, window time.Duration) *Gatekeeper {
+	return &Gatekeeper{
+		UserLimit:    userLimit,
+		GlobalLimit:  globalLimit,
+		Window:       window,
+		Blocklist:    UserList{},
+		userRequests: map[string][]time.Time{},
+		notified:     map[string]time.Time{},
+		recent:       map[string][]time.Time{},
+		loopBlocked:  map[string]time.Time{},
+	}
+}
+
+// Admit checks the mention against access lists, loop detection and quotas.
+// If the mention is rejected, reason explains why and notify tells whether
+// the requester should be told about hitting the quota. Admitted mentions
+// are counted against the quotas. Mentions must be admitted in chronological
+// order, at is the time of the mention.
+//
+// Only mentions replying to tweets of the bot count towards loop detection,
+// those are what another bot answering the bot's replies sends. Bursts of
+// ordinary requests are left to the user quota.
+func (g *Gatekeeper) Admit(mention twigger.Tweet, botID int64, at time.Time) (ok bool, reason string, notify bool) {
+	user := mention.User
+	if g.Blocklist.Contains(user.IdStr, user.ScreenName) {
+		return false, "Requester is blocklisted", false
+	}
+	if g.Allowlist != nil && !g.Allowlist.Contains(user.IdStr, user.ScreenName) {
+		return false, "Requester is not allowlisted", false
+	}
+	if user.Id == botID {
+		if !g.AllowSelf {
+			return false, "Mention is published by the bot itself", false
+		}
+		// Replies of a bot testing on its own account mention the account.
+		if strings.Contains(mention.FullText, ResponseText) || strings.Contains(mention.FullText, selfReferenceText) {
+			return false, "Mention is a reply of the bot", false
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := user.IdStr
+	if until, blocked := g.loopBlocked[key]; blocked {
+		if at.Before(until) {
+			return false, "Requester is ignored because of a reply loop", false
+		}
+		delete(g.loopBlocked, key)
+	}
+	if mention.InReplyToUserID == botID {
+		g.recent[key] = append(prune(g.recent[key], at, LoopWindow), at)
+		if len(g.recent[key]) >= LoopBurst {
+			g.loopBlocked[key] = at.Add(LoopBlockPeriod)
+			delete(g.recent, key)
+			return false, fmt.Sprintf("Requester replied to the bot %v times within %v, looks like a reply loop", LoopBurst, LoopWindow), false
+		}
+		if !g.AllowSelf {
+			return false, "Mention is a reply to a tweet of the bot", false
+		}
+	}
+
+	g.allRequests = prune(g.allRequests, at, g.Window)
+	g.userRequests[key] = prune(g.userRequests[key], at, g.Window)
+	if g.GlobalLimit > 0 && len(g.allRequests) >= g.GlobalLimit {
+		return false, "Global quota is exceeded", false
+	}
+	if g.UserLimit > 0 && len(g.userRequests[key]) >= g.UserLimit {
+		last, sent := g.notified[key]
+		notify = !sent || at.Sub(last) > g.Window
+		if notify {
+			g.notified[key] = at
+		}
+		return false, "User quota is exceeded", notify
+	}
+
+	g.allRequests = append(g.allRequests, at)
+	g.userRequests[key] = append(g.userRequests[key], at)
+	return true, "", false
+}
+
+// QuotaNotice is the text sent to a user who hits the user quota.
+func (g *Gatekeeper) QuotaNotice(screenName string) string {
+	return fmt.Sprintf(QuotaNoticeTempl, screenName, g.UserLimit, g.Window)
+}
+
+// prune drops times that fall out of the window ending at now.
+func prune(times []time.Time, now time.Time, window time.Duration) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	return times[i:]
+}
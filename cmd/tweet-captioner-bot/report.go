@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	reportDateLayout = "2006-01-02"
+
+	historyUsage = "Path of the task history file. Defaults to tasks.jsonl inside the output directory"
+	sinceUsage   = "Only include tasks finished on or after this date (YYYY-MM-DD)"
+	untilUsage   = "Only include tasks finished on or before this date (YYYY-MM-DD)"
+	topUsage     = "Number of most frequent failure reasons to list"
+)
+
+type reasonCount struct {
+	Reason string
+	Count  int
+}
+
+// RunReport implements the report subcommand which summarises the task
+// history of the bot.
+func RunReport(args []string, outPathDef string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	outPath := fs.String("out", outPathDef, outPathDefUsage)
+	fs.StringVar(outPath, "o", outPathDef, outPathDefUsage+shortcut)
+	historyPath := fs.String("history", "", historyUsage)
+	sinceStr := fs.String("since", "", sinceUsage)
+	untilStr := fs.String("until", "", untilUsage)
+	top := fs.Int("top", 5, topUsage)
+	fs.Parse(args)
+
+	if *historyPath == "" {
+		*historyPath = filepath.Join(*outPath, historyFileName)
+	}
+
+	var since, until time.Time
+	var err error
+	if *sinceStr != "" {
+		since, err = time.ParseInLocation(reportDateLayout, *sinceStr, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid since date %q. Error message: %v", *sinceStr, err)
+		}
+	}
+	if *untilStr != "" {
+		until, err = time.ParseInLocation(reportDateLayout, *untilStr, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid until date %q. Error message: %v", *untilStr, err)
+		}
+		until = until.AddDate(0, 0, 1)
+	}
+
+	records, err := LoadHistory(*historyPath, since, until)
+	if err != nil {
+		log.Fatalf("Task history %v couldn't be loaded. Error message: %v", *historyPath, err)
+	}
+	WriteReport(os.Stdout, records, *top)
+}
+
+func WriteReport(w io.Writer, records []TaskRecord, top int) {
+	total := len(records)
+	if total == 0 {
+		fmt.Fprintln(w, "No tasks found in the given date range.")
+		return
+	}
+
+	completed, rejected := 0, 0
+	latencies := []int64{}
+	reasons := map[string]int{}
+	first, last := records[0].FinishedAt, records[0].FinishedAt
+	for _, rec := range records {
+		if rec.FinishedAt.Before(first) {
+			first = rec.FinishedAt
+		}
+		if rec.FinishedAt.After(last) {
+			last = rec.FinishedAt
+		}
+		switch rec.Status {
+		case TaskCompleted:
+			completed++
+			latencies = append(latencies, rec.LatencyMs)
+		case TaskRejected:
+			rejected++
+		default:
+			reasons[rec.Reason]++
+		}
+	}
+	failed := total - completed - rejected
+
+	fmt.Fprintf(w, "Tasks finished between %v and %v\n", first.Local().Format(time.RFC1123), last.Local().Format(time.RFC1123))
+	fmt.Fprintf(w, "Total: %v, completed: %v, failed: %v, rejected: %v\n", total, completed, failed, rejected)
+	if accepted := completed + failed; accepted > 0 {
+		fmt.Fprintf(w, "Success rate: %.1f%%\n", 100*float64(completed)/float64(accepted))
+	}
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		sum := int64(0)
+		for _, l := range latencies {
+			sum += l
+		}
+		ms := func(v int64) time.Duration { return time.Duration(v) * time.Millisecond }
+		fmt.Fprintf(w, "Latency of completed tasks: mean %v, median %v, p95 %v, max %v\n",
+			ms(sum/int64(len(latencies))).Round(time.Second),
+			ms(percentile(latencies, 50)).Round(time.Second),
+			ms(percentile(latencies, 95)).Round(time.Second),
+			ms(latencies[len(latencies)-1]).Round(time.Second))
+	}
+
+	if failed == 0 {
+		return
+	}
+	counts := make([]reasonCount, 0, len(reasons))
+	for reason, count := range reasons {
+		counts = append(counts, reasonCount{reason, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Reason < counts[j].Reason
+	})
+	if top > 0 && len(counts) > top {
+		counts = counts[:top]
+	}
+	fmt.Fprintln(w, "Top failure reasons:")
+	for _, c := range counts {
+		fmt.Fprintf(w, "  %5v  %v\n", c.Count, c.Reason)
+	}
+}
+
+// percentile expects sorted values.
+func percentile(sorted []int64, p int) int64 {
+	idx := (len(sorted)*p + 99) / 100
+	if idx > 0 {
+		idx--
+	}
+	return sorted[idx]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/gusanmaz/twcapbot"
+	"math/rand"
+	"time"
+)
+
+const (
+	MaxAttempts    = 5                // Failed mentions are moved to dead letters after this many attempts
+	RetryBaseDelay = 30 * time.Second // Delay before the first retry, doubled on every further failure
+	RetryMaxDelay  = 5 * time.Minute
+	IdlePause      = time.Second // Pause of the reply worker when no task is due
+)
+
+// DeadLetters holds tasks that failed for good. They are kept in memory so
+// they can be inspected and requeued through the admin server.
+var DeadLetters SafeTasks
+
+// NextTask returns the key and a copy of the due task that has been waiting
+// the longest. ok is false if no task is due yet.
+func NextTask(now time.Time) (key string, m Mention, ok bool) {
+	Tasks.mu.Lock()
+	defer Tasks.mu.Unlock()
+	for k, v := range Tasks.Tasks {
+		if v.NextAttempt > now.Unix() {
+			continue
+		}
+		if !ok || v.Time < m.Time || (v.Time == m.Time && k < key) {
+			key, m, ok = k, v, true
+		}
+	}
+	return key, m, ok
+}
+
+// BackoffDelay returns the delay before the given retry of a task. A random
+// jitter of up to 20% keeps retries of simultaneous failures apart.
+func BackoffDelay(retry int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < retry && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay) / 5))
+	return delay + jitter
+}
+
+// RecordFailure stores the failure of an attempt on the task and either
+// schedules the next attempt or moves the task to dead letters.
+func RecordFailure(bot *twcapbot.TweetCaptionBot, key string, err error) {
+	now := time.Now()
+	Tasks.mu.Lock()
+	m, ok := Tasks.Tasks[key]
+	if !ok {
+		// Task is dropped through the admin server while it was being processed.
+		Tasks.mu.Unlock()
+		return
+	}
+	m.Failures = append(m.Failures, FailEvent{
+		Retry: len(m.Failures) + 1,
+		Time:  now.Unix(),
+		Error: err,
+	})
+
+	reason := ""
+	switch {
+	case twcapbot.IsPermanentError(err):
+		reason = "Permanent error: " + err.Error()
+	case len(m.Failures) >= MaxAttempts:
+		reason = "Reply discarded after reaching maximum number of attempts"
+	}
+
+	if reason == "" {
+		next := now.Add(BackoffDelay(len(m.Failures)))
+		if limitReset, limited := twcapbot.RetryAfter(err); limited && limitReset.After(next) {
+			next = limitReset
+		}
+		m.NextAttempt = next.Unix()
+		Tasks.Tasks[key] = m
+		Tasks.mu.Unlock()
+		bot.ErrLog.Printf("Attempt %v/%v for mention %v has failed. Next attempt at %v. Error message: %v",
+			len(m.Failures), MaxAttempts, m.IDStr, next.Format(time.RFC3339), err)
+		return
+	}
+	Tasks.mu.Unlock()
+	DeadLetter(bot, key, m, reason)
+}
+
+// DeadLetter removes the task from the pending tasks, records it as failed in
+// the task history and keeps it among dead letters.
+func DeadLetter(bot *twcapbot.TweetCaptionBot, key string, m Mention, reason string) {
+	m.Reason = reason
+	FinishTask(bot, key, NewTaskRecord(m, TaskFailed, reason, 0))
+
+	DeadLetters.mu.Lock()
+	DeadLetters.Tasks[key] = m
+	DeadLetters.mu.Unlock()
+}
+
+// Requeue moves a dead letter back to the pending tasks with a fresh reply
+// window and attempt budget.
+func Requeue(key string) bool {
+	DeadLetters.mu.Lock()
+	m, ok := DeadLetters.Tasks[key]
+	delete(DeadLetters.Tasks, key)
+	DeadLetters.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	m.Time = time.Now().Unix()
+	m.Failures = []FailEvent{}
+	m.NextAttempt = 0
+	m.Reason = ""
+	Tasks.mu.Lock()
+	Tasks.Tasks[key] = m
+	Tasks.mu.Unlock()
+	return true
+}
@@ -7,10 +7,11 @@ import (
 	"github.com/gusanmaz/twigger"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,11 +22,14 @@ type FailEvent struct {
 }
 
 type Mention struct {
-	IDStr    string
-	ID       int64
-	Time     int64
-	Tweet    twigger.Tweet
-	Failures []FailEvent
+	IDStr       string
+	ID          int64
+	Time        int64
+	Tweet       twigger.Tweet
+	Failures    []FailEvent
+	Manual      bool   // Enqueued through the admin server rather than by a mention
+	NextAttempt int64  // Unix time before which the task is not retried
+	Reason      string // Why the task is moved to dead letters
 }
 
 type SafeTasks struct {
@@ -40,12 +44,27 @@ const (
 	logFileDef   = "bot.log"
 	logFileUsage = "name of the bot file"
 
+	adminDef   = "127.0.0.1:8080"
+	adminUsage = "Listen address of the admin HTTP server. Empty value disables the server"
+
 	outPathDefUsage = "Output directory for saving original tweet media and captioned tweet photos"
 
+	fullURLsUsage      = "Show links in captions in full instead of abbreviated as Twitter displays them"
+	styleEntitiesUsage = "Highlight mentions and hashtags in captions"
+	metadataUsage      = "Comma separated metadata fields added to captions. Valid values: all, created, engagement, captured, replyto, place, client"
+	timezoneUsage      = "Time zone of times in caption metadata, e.g. Europe/Istanbul"
+
+	cardWidthDef        = 1000
+	cardWidthUsage      = "Width of tweet cards rendered for tweets without media"
+	cardBackgroundUsage = "Background color of tweet cards as #rrggbb"
+	cardForegroundUsage = "Text color of tweet cards as #rrggbb"
+	cardHighlightUsage  = "Color of mentions and hashtags of tweet cards as #rrggbb"
+
+	rendererUsage = "Caption renderer. Valid values: capdec (headless browser), go (pure Go). Defaults to capdec if available, go needs a build with -tags nocapdec"
+
 	shortcut          = " (shortcut)"
 	selfReferenceText = "foo(goo())"
 
-	TestBot              = true // Set true if bot account and test account is the same one
 	ResponseText         = "Your captioned tweet is ready!"
 	MentionQueryPause    = 12 * time.Second // in seconds
 	MaxRetrievalAttempts = 10
@@ -53,61 +72,42 @@ const (
 )
 
 var (
-	credsFlag          string
-	outPathFlag        string
-	logFileFlag        string
-	FailedTasksPath    string
-	CompletedTasksPath string
-	Tasks              SafeTasks
-	sinceID            int64
-	finished           chan bool
+	credsFlag    string
+	outPathFlag  string
+	logFileFlag  string
+	adminFlag    string
+	rendererFlag string
+
+	fullURLsFlag      bool
+	styleEntitiesFlag bool
+	metadataFlag      string
+	timezoneFlag      string
+
+	cardWidthFlag      int
+	cardBackgroundFlag string
+	cardForegroundFlag string
+	cardHighlightFlag  string
+
+	Tasks      SafeTasks
+	gatekeeper *Gatekeeper
+	sinceID    int64
+	finished   chan bool
 )
 
-func AppendToFile(path, text string) {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		panic(err)
-	}
-	_, err = f.WriteString(text + "\n")
-	f.Close()
-}
-
-func AppendToFailedTasksFile(text string) {
-	AppendToFile(FailedTasksPath, text)
-}
-
-func AppendToCompletedTasksFile(text string) {
-	AppendToFile(CompletedTasksPath, text)
-}
-
 func ReplyToMention(bot *twcapbot.TweetCaptionBot, tw twigger.Tweet) (int64, error) {
-	conn := bot.TwiggerConn
-	mentionText := tw.FullText
 	bot.InfoLog.Printf("Preparation of caption tweet for tweet (User: %v ID: %v) has started.", tw.User.ScreenName, tw.Id)
-	if TestBot && (strings.Contains(mentionText, ResponseText) || strings.Contains(mentionText, selfReferenceText)) {
-		bot.InfoLog.Println("Mention tweet is skipped for captioning because of self-reference")
-		return -1, nil
-	}
 
 	realTweetID := tw.InReplyToStatusID
-	err := bot.CaptionTweet(realTweetID, outPathFlag)
+	realTweet, quotedTweet, err := bot.FetchTweet(realTweetID)
 	if err != nil {
-		bot.ErrLog.Println("Error: %v", err)
+		bot.ErrLog.Printf("Error: %v", err)
 		return -1, err
 	}
-	realTweet, err := conn.GetSingleTweetFromID(realTweetID)
+	err = bot.CaptionFetchedTweet(realTweet, quotedTweet, outPathFlag)
 	if err != nil {
-		bot.ErrLog.Println("Error: %v", err)
+		bot.ErrLog.Printf("Error: %v", err)
 		return -1, err
 	}
-	var quotedTweet *twigger.Tweet = nil
-	if realTweet.QuotedStatusID != 0 {
-		*quotedTweet, err = conn.GetSingleTweetFromID(realTweet.QuotedStatusID)
-		if err != nil {
-			bot.ErrLog.Println("Error: %v", err)
-			return -1, err
-		}
-	}
 
 	fileNames := twcapbot.GenerateFileNamesForTweet(realTweet, quotedTweet)
 	pathNames := make([]string, len(fileNames))
@@ -116,17 +116,28 @@ func ReplyToMention(bot *twcapbot.TweetCaptionBot, tw twigger.Tweet) (int64, err
 		pathNames[i] = filepath.Join(outPathFlag, v.ShortDirName, v.LongCaptionFileName)
 	}
 	personalizedResponseText := fmt.Sprintf("@%v %v", tw.User.ScreenName, ResponseText)
-	respID, err := conn.PublishCollageTweetAsReply(pathNames, personalizedResponseText, tw.Id)
+	altTexts := twcapbot.AltTextsForTweet(realTweet, quotedTweet)
+	respIDs, err := bot.PublishCaptionThread(pathNames, altTexts, personalizedResponseText, tw.Id)
 	if err != nil {
-		bot.ErrLog.Println("Error: %v", err)
-		return -1, err
+		bot.ErrLog.Printf("Error: %v", err)
+		if len(respIDs) == 0 {
+			return -1, err
+		}
+		// Retrying would publish the first part of the thread once more.
+		bot.ErrLog.Printf("Only %v parts of the caption thread for tweet (ID: %v) have been published", len(respIDs), tw.Id)
 	}
+	respID := respIDs[0]
 	bot.InfoLog.Printf("Caption tweet for tweet (User: %v ID: %v) has been just published.", tw.User.ScreenName, tw.Id)
 	bot.InfoLog.Printf("ID of newly published caption tweet is %v", respID)
 	return respID, nil
 }
 
 func GetNewMentions(bot twcapbot.TweetCaptionBot) {
+	if IsPollingPaused() {
+		time.Sleep(MentionQueryPause)
+		return
+	}
+
 	fmt.Println("NEW MENTIONS")
 	i := 0
 	var mentions twigger.Tweets
@@ -142,115 +153,129 @@ func GetNewMentions(bot twcapbot.TweetCaptionBot) {
 	}
 	if err == nil {
 		bot.InfoLog.Printf("Retrieval of %v mention tweets has succeeded at %v. attempt.\n", len(mentions), i+1)
+		atomic.StoreInt64(&lastPollTime, time.Now().Unix())
 	} else {
 		bot.ErrLog.Println("Retrieval of mention tweets has failed!")
 	}
 
+	// Mentions are returned newest first, quotas expect them in chronological order.
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].Id < mentions[j].Id })
+
+	notices := []twigger.Tweet{}
+	optOuts := []twigger.Tweet{}
 	Tasks.mu.Lock()
 	for _, mention := range mentions {
+		if mention.Id > maxID {
+			maxID = mention.Id
+		}
+
 		text := mention.FullText
 		text = strings.ToLower(text)
-		if !strings.Contains(text, "caption"){
+		if IsOptOutRequest(text) {
+			optOuts = append(optOuts, mention)
 			continue
 		}
-
-		if mention.Id > maxID {
-			maxID = mention.Id
+		if !strings.Contains(text, "caption") {
+			continue
 		}
+
 		t, err := time.Parse(time.RubyDate, mention.CreatedAt)
 		mentionTime := t.Unix()
 		if err != nil {
 			mentionTime = time.Now().Unix()
 		}
-		Tasks.Tasks[mention.IdStr] = Mention{
+		m := Mention{
 			IDStr:    mention.IdStr,
 			ID:       mention.Id,
 			Time:     mentionTime,
 			Failures: []FailEvent{},
 			Tweet:    mention,
 		}
+
+		ok, reason, notify := gatekeeper.Admit(mention, bot.TwiggerConn.User.Id, time.Unix(mentionTime, 0))
+		if !ok {
+			bot.InfoLog.Printf("Mention %v of @%v is rejected: %v", mention.IdStr, mention.User.ScreenName, reason)
+			AppendToHistory(NewTaskRecord(m, TaskRejected, reason, 0))
+			if notify {
+				notices = append(notices, mention)
+			}
+			continue
+		}
+		Tasks.Tasks[mention.IdStr] = m
 	}
 	sinceID = maxID
 	Tasks.mu.Unlock()
+
+	for _, mention := range notices {
+		bot.PublishTextReply(gatekeeper.QuotaNotice(mention.User.ScreenName), mention.Id)
+	}
+	for _, mention := range optOuts {
+		OptOut(&bot, mention)
+	}
 	time.Sleep(MentionQueryPause)
 	bot.TwiggerConn.Reconnect()
 }
 
 func ReplyToNextMention(bot twcapbot.TweetCaptionBot) {
-	curKey := ""
-	curMention := Mention{}
-	tweet := twigger.Tweet{}
-	Tasks.mu.Lock()
-	maxRetry := 1000
-	for i, v := range Tasks.Tasks {
-		if len(v.Failures) < maxRetry {
-			curKey = i
-			curMention = v
-			tweet = v.Tweet
-			maxRetry = len(v.Failures)
-		}
-		if maxRetry == 0 {
-			break
-		}
-	}
-	Tasks.mu.Unlock()
-
-	if curKey == "" {
+	curKey, curMention, ok := NextTask(time.Now())
+	if !ok {
+		time.Sleep(IdlePause)
 		return
 	}
+	tweet := curMention.Tweet
 
-	now := time.Now()
-	nowString := now.String()
 	requestTime := time.Unix(curMention.Time, 0)
-	waitDuration := now.Sub(requestTime)
-
-	tweetID := tweet.IdStr
-	handle := tweet.User.ScreenName
+	waitDuration := time.Now().Sub(requestTime)
 
 	if waitDuration > ReplyWindow {
-		text := strings.Join([]string{nowString, handle, tweetID, "Reply discarded because of timeout"}, ",")
-		AppendToFailedTasksFile(text)
-		bot.ErrLog.Printf(text)
-		failures := curMention.Failures
-		for _, failure := range failures {
-			text := strings.Join([]string{fmt.Sprintf("%v", time.Unix(failure.Time, 0).String()),
-				failure.Error.Error()}, ",")
-			text = fmt.Sprintf("Failure #%v: ", failure.Retry) + text
-			AppendToFailedTasksFile(text)
-		}
+		DeadLetter(&bot, curKey, curMention, "Reply discarded because of timeout")
 		return
 	}
 
 	source := tweet.Source
 	if strings.Contains(source, bot.TwiggerConn.User.Name) {
-		text := strings.Join([]string{nowString, handle, tweetID, "Reply discarded because this tweet is generated by the same bot."}, ",")
-		AppendToFailedTasksFile(text)
-		bot.InfoLog.Printf(text)
+		FinishTask(&bot, curKey, NewTaskRecord(curMention, TaskFailed, "Reply discarded because this tweet is generated by the same bot", 0))
+		return
+	}
+
+	target := tweet.InReplyToStatusID
+	if reply, ok := RecentReply(target); ok {
+		ReplyWithLink(&bot, curKey, reply)
 		return
 	}
 
 	replyID, err := ReplyToMention(&bot, curMention.Tweet)
+	if err != nil {
+		RecordFailure(&bot, curKey, err)
+		return
+	}
+	bot.InfoLog.Printf("Reply for tweet#%v has been published as tweet#%v", curMention.ID, replyID)
+	FinishTask(&bot, curKey, NewTaskRecord(curMention, TaskCompleted, "", replyID))
+	if replyID <= 0 {
+		return
+	}
+
+	// Other requesters of the same tweet get a link instead of a new rendering.
+	RememberReply(target, replyID)
+	reply := TargetReply{ReplyID: replyID, Time: time.Now().Unix()}
+	for _, key := range TasksForTarget(target) {
+		ReplyWithLink(&bot, key, reply)
+	}
+}
+
+// FinishTask removes the task from the pending tasks and records its outcome
+// in the task history.
+func FinishTask(bot *twcapbot.TweetCaptionBot, key string, rec TaskRecord) {
+	Tasks.mu.Lock()
+	delete(Tasks.Tasks, key)
+	Tasks.mu.Unlock()
 
-	retry := 1
-	if curMention.Failures != nil {
-		retry = len(curMention.Failures) + 1
+	if rec.Status == TaskFailed {
+		bot.ErrLog.Printf("Task for mention %v of @%v has failed: %v", rec.MentionID, rec.Requester, rec.Reason)
 	}
+	err := AppendToHistory(rec)
 	if err != nil {
-		failure := FailEvent{
-			Retry: retry,
-			Time:  time.Now().Unix(),
-			Error: err,
-		}
-		curMention.Failures = append(curMention.Failures, failure)
-	} else {
-		Tasks.mu.Lock()
-		delete(Tasks.Tasks, curKey)
-		bot.InfoLog.Printf("Reply for tweet#%v has been published as tweet#%v", curMention.ID, replyID)
-		now := time.Now().String()
-		text := strings.Join([]string{now, curMention.Tweet.User.ScreenName, curMention.Tweet.User.IdStr,
-			curMention.IDStr, fmt.Sprintf("%v", replyID)}, ",")
-		AppendToCompletedTasksFile(text)
-		Tasks.mu.Unlock()
+		bot.ErrLog.Printf("Task %v couldn't be written into %v. Error message: %v", rec.MentionID, HistoryPath, err)
 	}
 }
 
@@ -261,6 +286,11 @@ func main() {
 	}
 	outPathDef := filepath.Join(homeDir, "tweet_caption_bot")
 
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		RunReport(os.Args[2:], outPathDef)
+		return
+	}
+
 	flag.StringVar(&credsFlag, "creds", credsDef, credsUsage)
 	flag.StringVar(&credsFlag, "c", credsDef, credsUsage+shortcut)
 
@@ -270,6 +300,30 @@ func main() {
 	flag.StringVar(&logFileFlag, "log", logFileDef, logFileUsage)
 	flag.StringVar(&logFileFlag, "l", logFileDef, logFileUsage+shortcut)
 
+	flag.StringVar(&adminFlag, "admin", adminDef, adminUsage)
+
+	flag.DurationVar(&cooldownFlag, "cooldown", cooldownDef, cooldownUsage)
+
+	flag.IntVar(&userQuotaFlag, "user-quota", userQuotaDef, userQuotaUsage)
+	flag.IntVar(&globalQuotaFlag, "global-quota", globalQuotaDef, globalQuotaUsage)
+	flag.DurationVar(&quotaWindowFlag, "quota-window", quotaWindowDef, quotaWindowUsage)
+	flag.StringVar(&blocklistFlag, "blocklist", "", blocklistUsage)
+	flag.StringVar(&allowlistFlag, "allowlist", "", allowlistUsage)
+	flag.BoolVar(&allowSelfFlag, "allow-self", false, allowSelfUsage)
+
+	flag.StringVar(&optOutFlag, "optout", "", optOutUsage)
+
+	flag.StringVar(&rendererFlag, "renderer", "", rendererUsage)
+	flag.BoolVar(&fullURLsFlag, "full-urls", false, fullURLsUsage)
+	flag.BoolVar(&styleEntitiesFlag, "style-entities", false, styleEntitiesUsage)
+	flag.StringVar(&metadataFlag, "metadata", "", metadataUsage)
+	flag.StringVar(&timezoneFlag, "timezone", "UTC", timezoneUsage)
+
+	flag.IntVar(&cardWidthFlag, "card-width", cardWidthDef, cardWidthUsage)
+	flag.StringVar(&cardBackgroundFlag, "card-background", "", cardBackgroundUsage)
+	flag.StringVar(&cardForegroundFlag, "card-foreground", "", cardForegroundUsage)
+	flag.StringVar(&cardHighlightFlag, "card-highlight", "", cardHighlightUsage)
+
 	flag.Parse()
 
 	logFilePath := filepath.Join(outPathFlag, logFileFlag)
@@ -279,8 +333,22 @@ func main() {
 	}
 	defer f.Close()
 
-	FailedTasksPath = path.Join(outPathFlag, "fail.tasks")
-	CompletedTasksPath = path.Join(outPathFlag, "success.tasks")
+	HistoryPath = filepath.Join(outPathFlag, historyFileName)
+
+	gatekeeper = NewGatekeeper(userQuotaFlag, globalQuotaFlag, quotaWindowFlag)
+	gatekeeper.AllowSelf = allowSelfFlag
+	if blocklistFlag != "" {
+		gatekeeper.Blocklist, err = LoadUserList(blocklistFlag)
+		if err != nil {
+			log.Panicf("Blocklist %v couldn't be loaded. Error message: %v", blocklistFlag, err)
+		}
+	}
+	if allowlistFlag != "" {
+		gatekeeper.Allowlist, err = LoadUserList(allowlistFlag)
+		if err != nil {
+			log.Panicf("Allowlist %v couldn't be loaded. Error message: %v", allowlistFlag, err)
+		}
+	}
 
 	creds, err := twigger.LoadCredentials(credsFlag)
 	if err != nil {
@@ -294,7 +362,35 @@ func main() {
 
 	bot := twcapbot.New(creds, f, []string{""}, outPathFlag)
 	twcapbot.SetBotScreenName(bot.TwiggerConn.User.ScreenName)
+
+	bot.Renderer, err = twcapbot.NewRenderer(rendererFlag, bot.JSCodes)
+	if err != nil {
+		log.Panicf("Renderer couldn't be created. Error message: %v", err)
+	}
+	bot.Captions = twcapbot.CaptionOptions{FullURLs: fullURLsFlag, StyleEntities: styleEntitiesFlag}
+	bot.Captions.Metadata, err = twcapbot.ParseMetadataFields(metadataFlag)
+	if err != nil {
+		log.Panicf("Invalid metadata fields. Error message: %v", err)
+	}
+	bot.Captions.Metadata.Location, err = time.LoadLocation(timezoneFlag)
+	if err != nil {
+		log.Panicf("Invalid time zone %v. Error message: %v", timezoneFlag, err)
+	}
+	err = bot.Card.SetAppearance(cardWidthFlag, cardBackgroundFlag, cardForegroundFlag, cardHighlightFlag)
+	if err != nil {
+		log.Panicf("Invalid tweet card options. Error message: %v", err)
+	}
+
+	if optOutFlag == "" {
+		optOutFlag = filepath.Join(outPathFlag, optOutFileName)
+	}
+	bot.OptOuts, err = twcapbot.LoadOptOutList(optOutFlag)
+	if err != nil {
+		log.Panicf("Opt-out list %v couldn't be loaded. Error message: %v", optOutFlag, err)
+	}
+
 	Tasks.Tasks = make(map[string]Mention)
+	DeadLetters.Tasks = make(map[string]Mention)
 
 	// If your Twitter account zero mention tweets bot would fail!
 	mentions, err := bot.TwiggerConn.GetRecentNMentions(1)
@@ -303,6 +399,10 @@ func main() {
 	}
 	sinceID = mentions[0].Id
 
+	if adminFlag != "" {
+		StartAdminServer(bot, adminFlag)
+	}
+
 	infGetNewMentions := func(id int, wg *sync.WaitGroup) {
 		defer wg.Done()
 		for {
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	batchJobsUsage = "Number of jobs run at the same time. Overrides concurrency of the job file"
+	batchRunDirDef = "{bot}_{bot_id}_{collection}_{kind}_{job}_{time}"
+
+	// Summaries are saved next to the tweets JSON files, verify skips them.
+	batchSummarySuffix = "_summary.json"
+
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// Sources of batch jobs and the commands retrieving them
+var batchSources = map[string]string{
+	"tweets":    "user",
+	"favorites": "favs",
+}
+
+// batchFile is the job file of the batch subcommand. Jobs and defaults map
+// flags of the user command, without the leading dash, to their values;
+// screenName and source select the tweets of a job.
+type batchFile struct {
+	Creds           string                   `json:"creds"`
+	Out             string                   `json:"out"`
+	Log             string                   `json:"log"`
+	Concurrency     int                      `json:"concurrency"`     // Jobs run at the same time
+	RequestInterval string                   `json:"requestInterval"` // Minimum time between API requests, e.g. 1s
+	Defaults        map[string]interface{}   `json:"defaults"`
+	Jobs            []map[string]interface{} `json:"jobs"`
+}
+
+// batchJob is a job of a batch ready to run.
+type batchJob struct {
+	screenName string
+	source     string
+	cmd        fetchCommand
+	o          *options
+	filter     twcapbot.TweetFilter
+	bot        *twcapbot.TweetCaptionBot
+}
+
+// batchSummary is the combined outcome of the jobs of a batch.
+type batchSummary struct {
+	JobFile    string         `json:"jobFile"`
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	DurationMs int64          `json:"durationMs"`
+	FailedJobs int            `json:"failedJobs"`
+	Retrieved  int            `json:"retrieved"`
+	Counts     map[string]int `json:"counts"` // Tweets of all jobs by status
+	Jobs       []jobSummary   `json:"jobs"`
+}
+
+type jobSummary struct {
+	ScreenName string         `json:"screenName"`
+	Source     string         `json:"source"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Retrieved  int            `json:"retrieved"`
+	Counts     map[string]int `json:"counts,omitempty"`
+	RunDir     string         `json:"runDir,omitempty"`
+	DurationMs int64          `json:"durationMs"`
+}
+
+// RunBatch implements the batch subcommand which archives several accounts
+// listed in a job file. Jobs share one connection, so they share its rate
+// limits as well.
+func RunBatch(args []string, outPathDef string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tweet-captioner-cli batch [flags] <job file>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	o := &options{}
+	fs.StringVar(&o.creds, "creds", credsDef, credsUsage)
+	fs.StringVar(&o.creds, "c", credsDef, credsUsage+shortcut)
+	fs.StringVar(&o.outPath, "out", outPathDef, outPathDefUsage)
+	fs.StringVar(&o.outPath, "o", outPathDef, outPathDefUsage+shortcut)
+	fs.StringVar(&o.logFile, "log", logFileDef, logFileUsage)
+	fs.StringVar(&o.logFile, "l", logFileDef, logFileUsage+shortcut)
+	jobs := fs.Int("jobs", 1, batchJobsUsage)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	jobPath := fs.Arg(0)
+
+	file := batchFile{}
+	data, err := ioutil.ReadFile(jobPath)
+	if err == nil {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		log.Panicf("Job file %v couldn't be loaded. Error message: %v", jobPath, err)
+	}
+	if len(file.Jobs) == 0 {
+		log.Panicf("Job file %v has no jobs", jobPath)
+	}
+
+	// Flags given on the command line win over the job file
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if file.Creds != "" && !set["creds"] && !set["c"] {
+		o.creds = file.Creds
+	}
+	if file.Out != "" && !set["out"] && !set["o"] {
+		o.outPath = file.Out
+	}
+	if file.Log != "" && !set["log"] && !set["l"] {
+		o.logFile = file.Log
+	}
+	if file.Concurrency > 0 && !set["jobs"] {
+		*jobs = file.Concurrency
+	}
+
+	batch := make([]batchJob, len(file.Jobs))
+	// Jobs of the same account and source started in the same minute are
+	// told apart by {job} only.
+	seen := map[string]int{}
+	for i, fields := range file.Jobs {
+		batch[i], err = newBatchJob(o, file.Defaults, fields)
+		if err != nil {
+			log.Panicf("Job %v of %v is invalid. Error message: %v", i+1, jobPath, err)
+		}
+		batch[i].o.job = fmt.Sprintf("job%v", i+1)
+		key := strings.Join([]string{strings.ToLower(batch[i].screenName), batch[i].source, batch[i].o.runDir}, " ")
+		if j, ok := seen[key]; ok && !strings.Contains(batch[i].o.runDir, "{job}") {
+			log.Panicf("Jobs %v and %v of %v archive %v of @%v into the same run directory, add {job} to their run-dir", j+1, i+1, jobPath, batch[i].source, batch[i].screenName)
+		}
+		seen[key] = i
+	}
+
+	f := openLog(o)
+	defer f.Close()
+	bot := connect(o, f)
+	if file.RequestInterval != "" {
+		interval, err := time.ParseDuration(file.RequestInterval)
+		if err != nil {
+			log.Panicf("Invalid request interval %v. Error message: %v", file.RequestInterval, err)
+		}
+		bot.TwiggerConn.Client.EnableThrottling(interval, 1)
+	}
+	for i := range batch {
+		batch[i].bot = jobBot(bot, batch[i])
+	}
+
+	summary := runBatch(batch, *jobs)
+	summary.JobFile = jobPath
+
+	summaryPath := filepath.Join(o.outPath, fmt.Sprintf("batch_%v%v", summary.StartedAt.Format("01_02_2006_15_04"), batchSummarySuffix))
+	data, err = json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(summaryPath, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		bot.ErrLog.Printf("Batch summary %v couldn't be written. Error message: %v", summaryPath, err)
+	} else {
+		bot.InfoLog.Printf("Batch summary is written to %v", summaryPath)
+	}
+	printBatchSummary(summary)
+
+	if summary.FailedJobs > 0 {
+		f.Close()
+		os.Exit(1)
+	}
+}
+
+// newBatchJob returns the job given by fields, which override defaults.
+func newBatchJob(batch *options, defaults, fields map[string]interface{}) (batchJob, error) {
+	merged := map[string]interface{}{}
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	job := batchJob{source: "tweets"}
+	if v, ok := merged["screenName"].(string); ok {
+		job.screenName = strings.TrimPrefix(v, "@")
+	}
+	if v, ok := merged["source"].(string); ok {
+		job.source = v
+	}
+	delete(merged, "screenName")
+	delete(merged, "source")
+	if job.screenName == "" {
+		return job, fmt.Errorf("screenName is missing")
+	}
+	name, ok := batchSources[job.source]
+	if !ok {
+		return job, fmt.Errorf("unknown source %q, valid values: tweets, favorites", job.source)
+	}
+	job.cmd = fetchCommands[name]
+
+	args, err := flagArgs(merged)
+	if err != nil {
+		return job, err
+	}
+	fs := flag.NewFlagSet(job.screenName, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	job.o = &options{creds: batch.creds, outPath: batch.outPath, logFile: batch.logFile}
+	registerRunFlags(fs, job.o)
+	fs.StringVar(&job.o.runDir, "run-dir", batchRunDirDef, runDirUsage)
+	registerCaptionFlags(fs, job.o)
+	registerFilterFlags(fs, job.o)
+	fs.IntVar(&job.o.max, "max", 0, maxUsage)
+	err = fs.Parse(args)
+	if err != nil {
+		return job, err
+	}
+	job.filter = job.o.tweetFilter()
+	return job, nil
+}
+
+// flagArgs turns the fields of a job into command line arguments. Lists are
+// joined with commas.
+func flagArgs(fields map[string]interface{}) ([]string, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := []string{}
+	for _, name := range names {
+		var value string
+		switch v := fields[name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = strconv.FormatBool(v)
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		default:
+			return nil, fmt.Errorf("invalid value of %v: %v", name, v)
+		}
+		args = append(args, fmt.Sprintf("-%v=%v", name, value))
+	}
+	return args, nil
+}
+
+// jobBot returns a bot for the job sharing the connection of bot. Its log
+// lines are prefixed with the job.
+func jobBot(bot *twcapbot.TweetCaptionBot, job batchJob) *twcapbot.TweetCaptionBot {
+	jb := *bot
+	prefix := fmt.Sprintf("%v[@%v %v] ", bot.InfoLog.Prefix(), job.screenName, job.source)
+	jb.InfoLog = log.New(bot.InfoLog.Writer(), prefix, bot.InfoLog.Flags())
+	jb.ErrLog = log.New(bot.ErrLog.Writer(), prefix, bot.ErrLog.Flags())
+	configureBot(&jb, job.o)
+	return &jb
+}
+
+// runBatch runs the jobs with up to workers jobs running at the same time.
+func runBatch(batch []batchJob, workers int) batchSummary {
+	if workers < 1 {
+		workers = 1
+	}
+	summary := batchSummary{StartedAt: time.Now().UTC(), Jobs: make([]jobSummary, len(batch)), Counts: map[string]int{}}
+
+	slots := make(chan bool, workers)
+	wg := sync.WaitGroup{}
+	for i := range batch {
+		wg.Add(1)
+		slots <- true
+		go func(i int) {
+			defer wg.Done()
+			summary.Jobs[i] = runBatchJob(batch[i])
+			<-slots
+		}(i)
+	}
+	wg.Wait()
+
+	summary.FinishedAt = time.Now().UTC()
+	summary.DurationMs = summary.FinishedAt.Sub(summary.StartedAt).Milliseconds()
+	for _, job := range summary.Jobs {
+		if job.Status == jobFailed {
+			summary.FailedJobs++
+		}
+		summary.Retrieved += job.Retrieved
+		for status, n := range job.Counts {
+			summary.Counts[status] += n
+		}
+	}
+	return summary
+}
+
+func runBatchJob(job batchJob) jobSummary {
+	start := time.Now()
+	job.bot.InfoLog.Printf("Job has started")
+	res, err := archive(job.bot, job.cmd, job.o, job.filter, []string{job.screenName})
+
+	s := jobSummary{ScreenName: job.screenName, Source: job.source, Status: jobCompleted, Retrieved: res.retrieved}
+	if err != nil {
+		s.Status, s.Error = jobFailed, err.Error()
+		job.bot.ErrLog.Printf("Retrieval of %v has failed! Error message: %v", job.cmd.kind, err)
+	} else {
+		s.Counts = res.manifest.Counts
+		s.RunDir = filepath.Base(res.rootPath)
+		job.bot.InfoLog.Printf("Job has completed")
+	}
+	s.DurationMs = time.Since(start).Milliseconds()
+	return s
+}
+
+// printBatchSummary prints the outcome of each job and the totals.
+func printBatchSummary(summary batchSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tRETRIEVED\tCAPTIONED\tSKIPPED\tFAILED\tTIME\tRESULT")
+	for _, job := range summary.Jobs {
+		result := job.RunDir
+		if job.Status == jobFailed {
+			result = "failed: " + job.Error
+		}
+		fmt.Fprintf(w, "@%v %v\t%v\t%v\t%v\t%v\t%v\t%v\n", job.ScreenName, job.Source, job.Retrieved,
+			job.Counts[twcapbot.TweetCaptioned], job.Counts[twcapbot.TweetSkipped], job.Counts[twcapbot.TweetFailed],
+			(time.Duration(job.DurationMs) * time.Millisecond).Round(time.Second), result)
+	}
+	fmt.Fprintf(w, "%v jobs\t%v\t%v\t%v\t%v\t%v\t%v of them failed\n", len(summary.Jobs), summary.Retrieved,
+		summary.Counts[twcapbot.TweetCaptioned], summary.Counts[twcapbot.TweetSkipped], summary.Counts[twcapbot.TweetFailed],
+		(time.Duration(summary.DurationMs) * time.Millisecond).Round(time.Second), summary.FailedJobs)
+	w.Flush()
+}
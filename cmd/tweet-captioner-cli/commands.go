@@ -0,0 +1,342 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxUsage       = "Maximum number of tweets to caption, 0 for as many as Twitter returns"
+	tweetFileUsage = "File listing tweet IDs or URLs, - for stdin"
+	tokenUsage     = "OAuth 2.0 user access token with bookmark.read, tweet.read and users.read scopes (required)"
+
+	maxCollectionName = 40
+)
+
+// fetchCommand is a command that retrieves tweets from Twitter and captions
+// them.
+type fetchCommand struct {
+	args  string // Arguments of the command as shown in usage
+	help  string
+	kind  string // Kind of the tweets in names of output files
+	nargs int    // Minimum number of arguments
+
+	flags func(fs *flag.FlagSet, o *options) // Defines flags of the command, may be nil
+
+	// input, if not nil, replaces the arguments given on the command line
+	// before they are checked against nargs.
+	input func(o *options, args []string) ([]string, error)
+
+	// fetch retrieves the tweets and returns them together with a name for
+	// the collection of tweets used in names of output files.
+	fetch func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error)
+}
+
+// Order of commands in usage
+var fetchCommandNames = []string{"user", "favs", "tweet", "search", "list", "bookmarks"}
+
+var fetchCommands = map[string]fetchCommand{
+	"user": {
+		args: "<screen name>", help: "Caption recent tweets of a user", kind: "tweets", nargs: 1,
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			tweets, err := bot.GetUserTweets(args[0], o.max)
+			return tweets, args[0], err
+		},
+	},
+	"favs": {
+		args: "<screen name>", help: "Caption recent favorites of a user", kind: "favorites", nargs: 1,
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			tweets, err := bot.GetUserFavorites(args[0], o.max)
+			return tweets, args[0], err
+		},
+	},
+	"tweet": {
+		args: "<id|url>...", help: "Caption the given tweets, - or a pipe reads them from stdin", kind: "selected", nargs: 1,
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.StringVar(&o.tweetFile, "file", "", tweetFileUsage)
+			fs.StringVar(&o.tweetFile, "f", "", tweetFileUsage+shortcut)
+		},
+		input: readTweetIDs,
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			ids := make([]int64, len(args))
+			for i, arg := range args {
+				id, err := twcapbot.ParseTweetID(arg)
+				if err != nil {
+					return nil, "", err
+				}
+				ids[i] = id
+			}
+			tweets, err := bot.LookupTweets(ids)
+			if err == nil && len(tweets) < len(ids) {
+				bot.InfoLog.Printf("%v of %v tweets are deleted or not available", len(ids)-len(tweets), len(ids))
+			}
+			return tweets, bot.TwiggerConn.User.ScreenName, err
+		},
+	},
+	"search": {
+		args: "<query>", help: "Caption recent tweets matching a search query", kind: "search", nargs: 1,
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			query := strings.Join(args, " ")
+			tweets, err := bot.SearchTweets(query, o.max)
+			return tweets, collectionName(query), err
+		},
+	},
+	"list": {
+		args: "<list id>", help: "Caption recent tweets of the members of a list", kind: "list", nargs: 1,
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			listID, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid list ID %q", args[0])
+			}
+			tweets, err := bot.GetListTweets(listID, o.max)
+			return tweets, args[0], err
+		},
+	},
+	"bookmarks": {
+		help: "Caption bookmarks of the user of an OAuth 2.0 token", kind: "bookmarks",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.StringVar(&o.token, "token", "", tokenUsage)
+		},
+		// The bearer token of the credentials file is app-only, which
+		// bookmarks are never served to.
+		input: func(o *options, args []string) ([]string, error) {
+			if o.token == "" {
+				return nil, errors.New("-token is required, bookmarks are only served to OAuth 2.0 user access tokens")
+			}
+			return args, nil
+		},
+		fetch: func(bot *twcapbot.TweetCaptionBot, o *options, args []string) (twigger.Tweets, string, error) {
+			tweets, err := bot.GetBookmarks(o.token, o.max)
+			return tweets, bot.TwiggerConn.User.ScreenName, err
+		},
+	},
+}
+
+func printUsage() {
+	w := os.Stderr
+	fmt.Fprintf(w, "Usage: tweet-captioner-cli <command> [flags] [arguments]\n\nCommands:\n")
+	for _, name := range fetchCommandNames {
+		cmd := fetchCommands[name]
+		fmt.Fprintf(w, "  %-24v %v\n", name+" "+cmd.args, cmd.help)
+	}
+	fmt.Fprintf(w, "  %-24v %v\n", "batch <job file>", "Caption tweets of several accounts listed in a job file")
+	fmt.Fprintf(w, "  %-24v %v\n", "recaption", "Caption saved tweets again without contacting Twitter")
+	fmt.Fprintf(w, "  %-24v %v\n", "gallery <run directory>", "Write the HTML gallery of an earlier run")
+	fmt.Fprintf(w, "  %-24v %v\n", "pdf <run directory>", "Write the PDF document of an earlier run")
+	fmt.Fprintf(w, "  %-24v %v\n", "verify [image...]", "Verify provenance of caption images against saved tweets")
+	fmt.Fprintf(w, "\nRun tweet-captioner-cli <command> -h for the flags of a command.\n")
+}
+
+// runFetch parses the flags and arguments of the command and runs it.
+func runFetch(name string, cmd fetchCommand, args []string, outPathDef string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tweet-captioner-cli %v [flags] %v\n\n%v\n\nFlags:\n", name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	o := &options{}
+	registerCommonFlags(fs, o, outPathDef)
+	registerCaptionFlags(fs, o)
+	registerFilterFlags(fs, o)
+	fs.IntVar(&o.max, "max", 0, maxUsage)
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	fs.Parse(args)
+
+	args = fs.Args()
+	if cmd.input != nil {
+		var err error
+		args, err = cmd.input(o, args)
+		if err != nil {
+			log.Panicf("Arguments of %v couldn't be read. Error message: %v", name, err)
+		}
+	}
+	if len(args) < cmd.nargs {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fetchAndCaption(cmd, o, args)
+}
+
+// fetchAndCaption retrieves tweets with the command, saves them as JSON and
+// captions them.
+func fetchAndCaption(cmd fetchCommand, o *options, args []string) {
+	filter := o.tweetFilter()
+	f := openLog(o)
+	defer f.Close()
+
+	bot := connect(o, f)
+	configureBot(bot, o)
+
+	_, err := archive(bot, cmd, o, filter, args)
+	if err != nil {
+		log.Printf("Retrieval of %v (%v) has failed!", cmd.kind, strings.Join(args, " "))
+		log.Panicf("Error message: %v", err)
+	}
+}
+
+// connect loads the credentials and returns a bot connected to Twitter.
+func connect(o *options, logFile *os.File) *twcapbot.TweetCaptionBot {
+	creds, err := twigger.LoadCredentials(o.creds)
+	if err != nil {
+		log.Panicf("Credentials file %v couldn't be loaded. Error message: %v", o.creds, err)
+	}
+
+	bot := twcapbot.New(creds, logFile, []string{""}, o.outPath)
+	twcapbot.SetBotScreenName(bot.TwiggerConn.User.ScreenName)
+	return bot
+}
+
+// archiveResult describes the outcome of archive.
+type archiveResult struct {
+	collection string
+	retrieved  int
+	rootPath   string
+	manifest   *twcapbot.Manifest
+}
+
+// archive retrieves tweets with the command, saves them as JSON and captions
+// those passing the filter into a run directory. Only retrieval errors are
+// returned, the outcome of each tweet is recorded in the manifest.
+func archive(bot *twcapbot.TweetCaptionBot, cmd fetchCommand, o *options, filter twcapbot.TweetFilter, args []string) (archiveResult, error) {
+	// Rate limits are waited out page by page, see configureBot.
+	tweets, collection, err := cmd.fetch(bot, o, args)
+	if err != nil {
+		return archiveResult{}, err
+	}
+
+	captured := time.Now()
+	timeName := captured.Format("01_02_2006_15_04")
+	jsonFileName := fmt.Sprintf("%v_%v_%v.json", collection, timeName, cmd.kind)
+	if o.job != "" {
+		jsonFileName = fmt.Sprintf("%v_%v_%v_%v.json", collection, timeName, cmd.kind, o.job)
+	}
+	jsonFilePath := filepath.Join(bot.OutDirPath, jsonFileName)
+
+	err = tweets.Save(jsonFilePath)
+	if err != nil {
+		bot.ErrLog.Printf("Saving of %v %v to %v has failed! Error message: %v", collection, cmd.kind, jsonFilePath, err)
+	}
+
+	twUserDirName := strings.NewReplacer(
+		"{bot}", bot.TwiggerConn.User.ScreenName,
+		"{bot_id}", fmt.Sprint(bot.TwiggerConn.User.Id),
+		"{kind}", cmd.kind,
+		"{collection}", collection,
+		"{time}", timeName,
+		"{job}", o.job,
+	).Replace(o.runDir)
+	captionRootDir := filepath.Join(bot.OutDirPath, twUserDirName)
+
+	info := runInfo{
+		title:    fmt.Sprintf("%v %v, %v", collection, cmd.kind, timeName),
+		account:  collection,
+		kind:     cmd.kind,
+		captured: captured,
+	}
+	r := newRun(bot, o, captionRootDir, jsonFilePath, info, tweets)
+	matched := r.filter(filter, tweets)
+	r.caption(matched, func(tw twigger.Tweet) error {
+		return bot.CaptionTweet(tw.Id, captionRootDir)
+	})
+	r.finish()
+	return archiveResult{collection: collection, retrieved: len(tweets), rootPath: captionRootDir, manifest: r.manifest}, nil
+}
+
+// captionTweets captions the tweets with up to workers tweets being
+// captioned at the same time.
+func captionTweets(bot *twcapbot.TweetCaptionBot, tweets twigger.Tweets, workers int, caption func(tw twigger.Tweet) error) {
+	tasks := make(chan int)
+	wg := sync.WaitGroup{}
+	if workers < 1 {
+		workers = 1
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				bot.InfoLog.Printf("Tweet captioning task %v/%v has started", i+1, len(tweets))
+				err := caption(tweets[i])
+
+				if err == nil {
+					bot.InfoLog.Printf("Tweet captioning task %v/%v has completed successfully", i+1, len(tweets))
+				} else {
+					bot.InfoLog.Printf("Tweet captioning task %v/%v has failed: %v", i+1, len(tweets), err)
+				}
+			}
+		}()
+	}
+	for i := range tweets {
+		tasks <- i
+	}
+	close(tasks)
+	wg.Wait()
+}
+
+// readTweetIDs collects the IDs of tweets given as arguments, in the file
+// given by -file and on stdin. Stdin is read if - is given as an argument or
+// file, or if it is a pipe and no tweets are given otherwise.
+func readTweetIDs(o *options, args []string) ([]string, error) {
+	readers := []io.Reader{}
+	stdin := o.tweetFile == "-"
+	for _, arg := range args {
+		if arg == "-" {
+			stdin = true
+			continue
+		}
+		readers = append(readers, strings.NewReader(arg+"\n"))
+	}
+	if o.tweetFile != "" && o.tweetFile != "-" {
+		f, err := os.Open(o.tweetFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readers = append(readers, f, strings.NewReader("\n"))
+	}
+	if !stdin && len(readers) == 0 {
+		finfo, err := os.Stdin.Stat()
+		stdin = err == nil && finfo.Mode()&os.ModeCharDevice == 0
+	}
+	if stdin {
+		readers = append(readers, os.Stdin)
+	}
+
+	ids, invalid, err := twcapbot.ReadTweetIDs(io.MultiReader(readers...))
+	for _, s := range invalid {
+		log.Printf("Skipping %q, it is not a tweet ID or URL", s)
+	}
+	args = make([]string, len(ids))
+	for i, id := range ids {
+		args[i] = strconv.FormatInt(id, 10)
+	}
+	return args, err
+}
+
+var unsafeNameRegex = regexp.MustCompile(`[^\pL\pN_-]+`)
+
+// collectionName turns a search query into a part of a file name.
+func collectionName(query string) string {
+	name := strings.Trim(unsafeNameRegex.ReplaceAllString(query, "_"), "_")
+	if r := []rune(name); len(r) > maxCollectionName {
+		name = string(r[:maxCollectionName])
+	}
+	if name == "" {
+		name = "search"
+	}
+	return name
+}
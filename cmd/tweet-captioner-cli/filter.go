@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"github.com/gusanmaz/twcapbot"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	sinceUsage      = "Caption tweets created on or after this date (2006-01-02 or RFC 3339) in the time zone of -timezone"
+	untilUsage      = "Caption tweets created on or before this date (2006-01-02 or RFC 3339) in the time zone of -timezone"
+	mediaOnlyUsage  = "Caption tweets with media only"
+	textOnlyUsage   = "Caption tweets without media only"
+	noRetweetsUsage = "Skip retweets"
+	noRepliesUsage  = "Skip replies"
+	keywordsUsage   = "Comma separated keywords, caption tweets containing one of them only"
+	matchUsage      = "Regular expression, caption tweets whose text matches it only"
+	minLikesUsage   = "Caption tweets with at least this many likes only"
+
+	filterDateLayout = "2006-01-02"
+)
+
+// registerFilterFlags defines the flags that select which of the retrieved
+// tweets are captioned.
+func registerFilterFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.since, "since", "", sinceUsage)
+	fs.StringVar(&o.until, "until", "", untilUsage)
+	fs.BoolVar(&o.mediaOnly, "media-only", false, mediaOnlyUsage)
+	fs.BoolVar(&o.textOnly, "text-only", false, textOnlyUsage)
+	fs.BoolVar(&o.noRetweets, "no-retweets", false, noRetweetsUsage)
+	fs.BoolVar(&o.noReplies, "no-replies", false, noRepliesUsage)
+	fs.StringVar(&o.keywords, "keywords", "", keywordsUsage)
+	fs.StringVar(&o.match, "match", "", matchUsage)
+	fs.IntVar(&o.minLikes, "min-likes", 0, minLikesUsage)
+}
+
+// tweetFilter returns the filter set by the flags of registerFilterFlags.
+func (o *options) tweetFilter() twcapbot.TweetFilter {
+	if o.mediaOnly && o.textOnly {
+		log.Panicf("-media-only and -text-only cannot be used together")
+	}
+	loc, err := time.LoadLocation(o.timezone)
+	if err != nil {
+		log.Panicf("Invalid time zone %v. Error message: %v", o.timezone, err)
+	}
+
+	filter := twcapbot.TweetFilter{
+		MediaOnly:       o.mediaOnly,
+		TextOnly:        o.textOnly,
+		ExcludeRetweets: o.noRetweets,
+		ExcludeReplies:  o.noReplies,
+		MinLikes:        o.minLikes,
+	}
+	if o.since != "" {
+		filter.Since = parseFilterDate(o.since, loc, false)
+	}
+	if o.until != "" {
+		filter.Until = parseFilterDate(o.until, loc, true)
+	}
+	for _, k := range strings.Split(o.keywords, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			filter.Keywords = append(filter.Keywords, k)
+		}
+	}
+	if o.match != "" {
+		filter.Pattern, err = regexp.Compile(o.match)
+		if err != nil {
+			log.Panicf("Invalid regular expression %v. Error message: %v", o.match, err)
+		}
+	}
+	return filter
+}
+
+// parseFilterDate parses a date flag. A date without time of -until covers
+// the whole day, so the filter ends at the start of the next day.
+func parseFilterDate(s string, loc *time.Location, until bool) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		if until {
+			return t.Add(time.Second)
+		}
+		return t
+	}
+	t, err := time.ParseInLocation(filterDateLayout, s, loc)
+	if err != nil {
+		log.Panicf("Invalid date %v, dates are given as %v. Error message: %v", s, filterDateLayout, err)
+	}
+	if until {
+		return t.AddDate(0, 0, 1)
+	}
+	return t
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	noGalleryUsage     = "Don't write the HTML gallery of captioned tweets"
+	galleryTweetsUsage = "JSON file of the tweets captioned in the run"
+)
+
+// RunGallery implements the gallery subcommand which writes the HTML gallery
+// of an earlier run.
+func RunGallery(args []string) {
+	fs := flag.NewFlagSet("gallery", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tweet-captioner-cli gallery -tweets <json file> <run directory>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	tweetsPath := fs.String("tweets", "", galleryTweetsUsage)
+	timezone := fs.String("timezone", "UTC", timezoneUsage)
+	layout := fs.String("layout", twcapbot.LayoutUser, layoutUsage)
+	fs.Parse(args)
+
+	if *tweetsPath == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	rootPath := fs.Arg(0)
+
+	tweets, err := twcapbot.LoadSavedTweets(*tweetsPath)
+	if err != nil {
+		log.Fatalf("Saved tweets couldn't be loaded. Error message: %v", err)
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid time zone %v. Error message: %v", *timezone, err)
+	}
+	opts := twcapbot.GalleryOptions{Title: filepath.Base(rootPath), Location: loc}
+	opts.Layout, err = twcapbot.ParseLayout(*layout, loc)
+	if err != nil {
+		log.Fatalf("Invalid layout. Error message: %v", err)
+	}
+	n, err := twcapbot.WriteGallery(rootPath, tweets, opts)
+	if err != nil {
+		log.Fatalf("Gallery of %v couldn't be written. Error message: %v", rootPath, err)
+	}
+	fmt.Printf("Gallery of %v tweets is written to %v\n", n, filepath.Join(rootPath, twcapbot.GalleryIndexFile))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/gusanmaz/twcapbot"
+	"sync"
+	"time"
+)
+
+// rateLimitRetries is the number of times a request hitting a rate limit is
+// repeated after the limit resets.
+const rateLimitRetries = 3
+
+// rateLimitPause is the pause after a rate limit error without reset time.
+const rateLimitPause = time.Minute
+
+// rateLimits holds requests back while a rate limit of Twitter is exhausted.
+// All runs of the process share it together with their connection, so once
+// a run hits a limit the others wait for the reset as well instead of
+// failing on the same limit one after another.
+type rateLimits struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+var apiLimits = &rateLimits{}
+
+// do runs f once no limit is exhausted. If f fails because of a rate limit,
+// it is run again after the limit resets.
+func (l *rateLimits) do(bot *twcapbot.TweetCaptionBot, f func() error) error {
+	var err error
+	for attempt := 0; attempt <= rateLimitRetries; attempt++ {
+		l.wait()
+		err = f()
+		reset, limited := twcapbot.RetryAfter(err)
+		if !limited {
+			return err
+		}
+		if reset.Before(time.Now()) {
+			reset = time.Now().Add(rateLimitPause)
+		}
+		if l.limit(reset) {
+			bot.InfoLog.Printf("Rate limit is exhausted, requests are paused until %v", reset.Format(time.RFC3339))
+		}
+	}
+	return err
+}
+
+// limit pauses requests until reset and reports whether the pause is
+// extended.
+func (l *rateLimits) limit(reset time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if reset.After(l.until) {
+		l.until = reset
+		return true
+	}
+	return false
+}
+
+func (l *rateLimits) wait() {
+	l.mu.Lock()
+	until := l.until
+	l.mu.Unlock()
+	if d := time.Until(until); d > 0 {
+		time.Sleep(d)
+	}
+}
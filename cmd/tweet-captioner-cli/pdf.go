@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pdfOutUsage     = "Path of the PDF document. Defaults to the run directory with a .pdf extension"
+	pdfAccountUsage = "Account shown on the cover page. Defaults to the name of the JSON file"
+	pdfKindUsage    = "Tweet type shown on the cover page, e.g. tweets or favorites"
+)
+
+// RunPDF implements the pdf subcommand which writes the PDF document of an
+// earlier run.
+func RunPDF(args []string) {
+	fs := flag.NewFlagSet("pdf", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tweet-captioner-cli pdf -tweets <json file> <run directory>\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	tweetsPath := fs.String("tweets", "", galleryTweetsUsage)
+	outPath := fs.String("out", "", pdfOutUsage)
+	account := fs.String("account", "", pdfAccountUsage)
+	kind := fs.String("kind", "", pdfKindUsage)
+	timezone := fs.String("timezone", "UTC", timezoneUsage)
+	layout := fs.String("layout", twcapbot.LayoutUser, layoutUsage)
+	fs.Parse(args)
+
+	if *tweetsPath == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	rootPath := filepath.Clean(fs.Arg(0))
+	if *outPath == "" {
+		*outPath = rootPath + ".pdf"
+	}
+	if *account == "" {
+		*account = strings.TrimSuffix(filepath.Base(*tweetsPath), filepath.Ext(*tweetsPath))
+	}
+
+	tweets, err := twcapbot.LoadSavedTweets(*tweetsPath)
+	if err != nil {
+		log.Fatalf("Saved tweets couldn't be loaded. Error message: %v", err)
+	}
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatalf("Invalid time zone %v. Error message: %v", *timezone, err)
+	}
+	opts := twcapbot.PDFOptions{
+		Title:    filepath.Base(rootPath),
+		Account:  *account,
+		Kind:     *kind,
+		Captured: savedTime(*tweetsPath),
+		Location: loc,
+	}
+	opts.Layout, err = twcapbot.ParseLayout(*layout, loc)
+	if err != nil {
+		log.Fatalf("Invalid layout. Error message: %v", err)
+	}
+	n, err := twcapbot.WritePDF(*outPath, rootPath, tweets, opts)
+	if err != nil {
+		log.Fatalf("PDF document of %v couldn't be written. Error message: %v", rootPath, err)
+	}
+	fmt.Printf("PDF document of %v tweets is written to %v\n", n, *outPath)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	recaptionTweetsUsage = "JSON file of tweets saved by tweet-captioner-cli"
+	mediaDirUsage        = "Directory holding media saved by earlier runs, searched recursively. Defaults to the output directory"
+	botNameUsage         = "Screen name of the bot mentioned in caption notes"
+)
+
+// RunRecaption implements the recaption subcommand which captions tweets
+// saved by an earlier run again, e.g. with another renderer or caption
+// options. Media saved by earlier runs is reused and Twitter is not
+// contacted.
+func RunRecaption(args []string, outPathDef string) {
+	fs := flag.NewFlagSet("recaption", flag.ExitOnError)
+	o := &options{}
+	registerOutputFlags(fs, o, outPathDef)
+	tweetsPath := fs.String("tweets", "", recaptionTweetsUsage)
+	mediaDir := fs.String("media", "", mediaDirUsage)
+	botName := fs.String("bot", "", botNameUsage)
+	registerCaptionFlags(fs, o)
+	registerFilterFlags(fs, o)
+	fs.Parse(args)
+
+	if *tweetsPath == "" || *botName == "" {
+		fmt.Fprintln(os.Stderr, "recaption needs the -tweets and -bot flags")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *mediaDir == "" {
+		*mediaDir = o.outPath
+	}
+
+	filter := o.tweetFilter()
+	f := openLog(o)
+	defer f.Close()
+
+	tweets, err := twcapbot.LoadSavedTweets(*tweetsPath)
+	if err != nil {
+		log.Panicf("Saved tweets couldn't be loaded. Error message: %v", err)
+	}
+
+	bot := twcapbot.NewOffline(f, []string{""}, o.outPath)
+	twcapbot.SetBotScreenName(*botName)
+	configureBot(bot, o)
+
+	bot.LocalMedia, err = twcapbot.NewMediaIndex(*mediaDir)
+	if err != nil {
+		log.Panicf("Media directory %v couldn't be indexed. Error message: %v", *mediaDir, err)
+	}
+	bot.InfoLog.Printf("%v files are found in media directory %v", bot.LocalMedia.Len(), *mediaDir)
+
+	timeName := time.Now().Format("01_02_2006_15_04")
+	jsonName := strings.TrimSuffix(filepath.Base(*tweetsPath), filepath.Ext(*tweetsPath))
+	captionRootDir := filepath.Join(o.outPath, fmt.Sprintf("%v_recaption_%v", jsonName, timeName))
+
+	info := runInfo{
+		title:    fmt.Sprintf("%v recaptioned, %v", jsonName, timeName),
+		account:  jsonName,
+		kind:     "recaptioned",
+		captured: savedTime(*tweetsPath),
+	}
+	r := newRun(bot, o, captionRootDir, *tweetsPath, info, tweets)
+	tweets = r.filter(filter, tweets)
+	r.caption(tweets, func(tw twigger.Tweet) error {
+		return bot.RecaptionTweet(tw, captionRootDir)
+	})
+	r.finish()
+}
+
+// savedTime returns the time the tweets in the file were saved, i.e.
+// retrieved from Twitter.
+func savedTime(path string) time.Time {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return finfo.ModTime()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	pdfUsage        = "Also write the captions of the run into a PDF document next to its directory"
+	bundleUsage     = "Also write the run into a bundle next to its directory. Valid values: zip, tar.gz"
+	bundleOnlyUsage = "Remove files of the run once they are written into the bundle, keeping the bundle only. Implies -bundle zip unless -bundle is given"
+)
+
+// runInfo describes a run on the gallery and in the PDF document.
+type runInfo struct {
+	title    string
+	account  string // Account or collection whose tweets are captioned
+	kind     string
+	captured time.Time // Time the tweets were retrieved
+}
+
+// run collects the outputs of a run besides the captions: the manifest, the
+// gallery, the PDF document and the bundle. Files of each tweet are written
+// into the bundle as soon as the tweet is captioned, so with -bundle-only
+// they can be removed right away and a run never needs room for both the
+// directory and the bundle.
+type run struct {
+	bot      *twcapbot.TweetCaptionBot
+	o        *options
+	rootPath string
+	jsonPath string
+
+	manifest *twcapbot.Manifest
+	gallery  *twcapbot.Gallery
+
+	pdf     *twcapbot.PDF
+	pdfFile *os.File
+	pdfPath string
+
+	bundle     *twcapbot.Bundle
+	bundleFile *os.File
+	bundlePath string
+
+	mu        sync.Mutex
+	bundleErr bool // Some files are missing from the bundle
+
+	// Tweets quoting or quoted by other tweets of the run, their media may
+	// be shared and is only removed at the end of the run.
+	shared map[int64]bool
+}
+
+// newRun prepares the outputs of a run captioning the tweets under rootPath.
+// jsonPath is the file the tweets are saved to.
+func newRun(bot *twcapbot.TweetCaptionBot, o *options, rootPath, jsonPath string, info runInfo, tweets twigger.Tweets) *run {
+	r := &run{bot: bot, o: o, rootPath: rootPath, jsonPath: jsonPath, shared: map[int64]bool{}}
+	r.manifest = twcapbot.NewManifest(rootPath, tweets)
+	r.manifest.Collection = info.account
+	r.manifest.Kind = info.kind
+	r.manifest.Layout = o.layout
+	r.manifest.CapturedAt = info.captured.UTC()
+	for _, tw := range tweets {
+		if tw.QuotedStatusID != 0 {
+			r.shared[tw.Id] = true
+			r.shared[tw.QuotedStatusID] = true
+		}
+	}
+
+	var err error
+	if !o.noGallery {
+		opts := twcapbot.GalleryOptions{Title: info.title, Location: bot.Captions.Metadata.Location, Layout: bot.Layout}
+		r.gallery, err = twcapbot.NewGallery(rootPath, opts)
+		if err != nil {
+			log.Panicf("Gallery of %v couldn't be created. Error message: %v", rootPath, err)
+		}
+	}
+
+	if o.pdf {
+		r.pdfPath = rootPath + ".pdf"
+		r.pdfFile, err = os.Create(r.pdfPath)
+		if err != nil {
+			log.Panicf("PDF document %v couldn't be created. Error message: %v", r.pdfPath, err)
+		}
+		opts := twcapbot.PDFOptions{
+			Title:    info.title,
+			Account:  info.account,
+			Kind:     info.kind,
+			Captured: info.captured,
+			Location: bot.Captions.Metadata.Location,
+			Layout:   bot.Layout,
+		}
+		r.pdf, err = twcapbot.NewPDF(r.pdfFile, rootPath, opts)
+		if err != nil {
+			log.Panicf("PDF document %v couldn't be created. Error message: %v", r.pdfPath, err)
+		}
+	}
+
+	if o.bundleOnly && o.bundle == "" {
+		o.bundle = twcapbot.BundleZip
+	}
+	if o.bundle != "" {
+		r.bundlePath = rootPath + "." + o.bundle
+		format, err := twcapbot.BundleFormat(r.bundlePath)
+		if err != nil {
+			log.Panicf("Invalid bundle format. Error message: %v", err)
+		}
+		r.bundleFile, err = os.Create(r.bundlePath)
+		if err != nil {
+			log.Panicf("Bundle %v couldn't be created. Error message: %v", r.bundlePath, err)
+		}
+		r.bundle, err = twcapbot.NewBundle(r.bundleFile, format, filepath.Base(rootPath))
+		if err != nil {
+			log.Panicf("Bundle %v couldn't be created. Error message: %v", r.bundlePath, err)
+		}
+	}
+	return r
+}
+
+// filter returns the tweets that pass the filter. The others are recorded as
+// skipped.
+func (r *run) filter(filter twcapbot.TweetFilter, tweets twigger.Tweets) twigger.Tweets {
+	matched := twigger.Tweets{}
+	for _, tw := range tweets {
+		if filter.Match(tw) {
+			matched = append(matched, tw)
+		} else {
+			r.manifest.Skip(tw, "left out by filters")
+		}
+	}
+	if len(matched) < len(tweets) {
+		r.bot.InfoLog.Printf("%v of %v tweets are left out by filters", len(tweets)-len(matched), len(tweets))
+	}
+	return matched
+}
+
+// caption captions the tweets with captionTweets, records the outcome of
+// each tweet in the manifest and adds each captioned tweet to the outputs of
+// the run. Tweets hitting a rate limit are captioned again once it resets.
+func (r *run) caption(tweets twigger.Tweets, caption func(tw twigger.Tweet) error) {
+	captionTweets(r.bot, tweets, r.o.concurrency, func(tw twigger.Tweet) error {
+		start := time.Now()
+		err := apiLimits.do(r.bot, func() error {
+			return caption(tw)
+		})
+		r.manifest.Record(r.rootPath, tw, r.bot.Layout, start, err)
+		if err == nil {
+			r.add(tw)
+		}
+		return err
+	})
+}
+
+// add adds the files of a captioned tweet to the gallery, the PDF document
+// and the bundle.
+func (r *run) add(tw twigger.Tweet) {
+	if r.gallery != nil {
+		_, err := r.gallery.Add(tw)
+		if err != nil {
+			r.bot.ErrLog.Printf("Tweet (ID: %v) couldn't be added to the gallery. Error message: %v", tw.Id, err)
+		}
+	}
+	if r.pdf != nil {
+		_, err := r.pdf.Add(tw)
+		if err != nil {
+			r.bot.ErrLog.Printf("Tweet (ID: %v) couldn't be added to the PDF document. Error message: %v", tw.Id, err)
+		}
+	}
+	if r.bundle == nil {
+		return
+	}
+
+	paths, media := []string{}, map[string]bool{}
+	for _, f := range twcapbot.TweetFiles(r.rootPath, tw, r.bot.Layout) {
+		if f.Media != "" {
+			paths = append(paths, f.Media)
+			media[f.Media] = true
+		}
+		paths = append(paths, f.Caption)
+		if f.HTML != "" {
+			paths = append(paths, f.HTML)
+		}
+	}
+	for _, p := range paths {
+		err := r.bundle.AddFile(p, filepath.Join(r.rootPath, p))
+		if err != nil {
+			r.bot.ErrLog.Printf("Files of tweet (ID: %v) couldn't be written into bundle %v. Error message: %v", tw.Id, r.bundlePath, err)
+			r.setBundleErr()
+			return
+		}
+	}
+
+	if !r.o.bundleOnly {
+		return
+	}
+	for _, p := range paths {
+		if !media[p] || !r.shared[tw.Id] {
+			os.Remove(filepath.Join(r.rootPath, p))
+		}
+	}
+}
+
+func (r *run) setBundleErr() {
+	r.mu.Lock()
+	r.bundleErr = true
+	r.mu.Unlock()
+}
+
+// finish writes the manifest and the gallery, completes the PDF document and
+// the bundle with the manifest, the gallery and the saved tweets and, with
+// -bundle-only, removes the run directory.
+func (r *run) finish() {
+	if r.jsonPath != "" {
+		f, err := twcapbot.NewManifestFile(filepath.Dir(r.jsonPath), filepath.Base(r.jsonPath))
+		if err == nil {
+			r.manifest.TweetsFile = &f
+		}
+	}
+	manifestPath := filepath.Join(r.rootPath, twcapbot.ManifestFileName)
+	err := os.MkdirAll(r.rootPath, 0750)
+	if err == nil {
+		err = r.manifest.Write(manifestPath)
+	}
+	if err != nil {
+		r.bot.ErrLog.Printf("Manifest %v couldn't be written. Error message: %v", manifestPath, err)
+	} else {
+		r.bot.InfoLog.Printf("Manifest of the run is written to %v", manifestPath)
+	}
+
+	if r.gallery != nil {
+		n, err := r.gallery.Write()
+		if err != nil {
+			r.bot.ErrLog.Printf("Gallery of %v couldn't be written. Error message: %v", r.rootPath, err)
+		} else {
+			r.bot.InfoLog.Printf("Gallery of %v tweets is written to %v", n, filepath.Join(r.rootPath, twcapbot.GalleryIndexFile))
+		}
+	}
+	if r.pdf != nil {
+		n, err := r.pdf.Close()
+		if err == nil {
+			err = r.pdfFile.Close()
+		} else {
+			r.pdfFile.Close()
+		}
+		if err != nil {
+			r.bot.ErrLog.Printf("PDF document %v couldn't be completed. Error message: %v", r.pdfPath, err)
+		} else {
+			r.bot.InfoLog.Printf("PDF document of %v tweets is written to %v", n, r.pdfPath)
+		}
+	}
+	if r.bundle == nil {
+		return
+	}
+
+	files := []string{twcapbot.ManifestFileName}
+	if r.gallery != nil {
+		files = append(files, r.gallery.Files()...)
+	}
+	for _, p := range files {
+		err := r.bundle.AddFile(p, filepath.Join(r.rootPath, p))
+		if err != nil {
+			r.bot.ErrLog.Printf("%v couldn't be written into bundle %v. Error message: %v", p, r.bundlePath, err)
+			r.setBundleErr()
+			break
+		}
+	}
+	if r.jsonPath != "" {
+		err := r.bundle.AddFile(filepath.Base(r.jsonPath), r.jsonPath)
+		if err != nil {
+			r.bot.ErrLog.Printf("Tweets couldn't be written into bundle %v. Error message: %v", r.bundlePath, err)
+			r.setBundleErr()
+		}
+	}
+
+	err = r.bundle.Close()
+	if err == nil {
+		err = r.bundleFile.Close()
+	} else {
+		r.bundleFile.Close()
+	}
+	if err != nil {
+		r.bot.ErrLog.Printf("Bundle %v couldn't be completed. Error message: %v", r.bundlePath, err)
+		return
+	}
+	r.bot.InfoLog.Printf("Run is bundled into %v", r.bundlePath)
+
+	if r.o.bundleOnly {
+		if r.bundleErr {
+			r.bot.ErrLog.Printf("Run directory %v is kept as some of its files are missing from the bundle", r.rootPath)
+			return
+		}
+		err = os.RemoveAll(r.rootPath)
+		if err != nil {
+			r.bot.ErrLog.Printf("Run directory %v couldn't be removed. Error message: %v", r.rootPath, err)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"github.com/gusanmaz/twcapbot"
-	"github.com/gusanmaz/twigger"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,17 +26,78 @@ const (
 
 	outPathDefUsage = "Output directory for saving original tweet media and captioned tweet photos"
 
+	fullURLsUsage      = "Show links in captions in full instead of abbreviated as Twitter displays them"
+	styleEntitiesUsage = "Highlight mentions and hashtags in captions"
+	metadataUsage      = "Comma separated metadata fields added to captions. Valid values: all, created, engagement, captured, replyto, place, client"
+	timezoneUsage      = "Time zone of times in caption metadata, e.g. Europe/Istanbul"
+
+	cardWidthDef        = 1000
+	cardWidthUsage      = "Width of tweet cards rendered for tweets without media"
+	cardBackgroundUsage = "Background color of tweet cards as #rrggbb"
+	cardForegroundUsage = "Text color of tweet cards as #rrggbb"
+	cardHighlightUsage  = "Color of mentions and hashtags of tweet cards as #rrggbb"
+
+	layoutUsage = "Layout of output files: user (a directory per author), flat, date (a directory per day), split (originals and captions of each author apart) or a pattern such as {date}/{screen_name}_{tweet_id}"
+	runDirDef   = "{bot}_{bot_id}_{kind}_{time}"
+	runDirUsage = "Name pattern of the directory of a run. Placeholders: {bot}, {bot_id}, {kind}, {collection}, {time} and, in batch jobs, {job}"
+
+	concurrencyDef   = 1
+	concurrencyUsage = "Number of tweets captioned at the same time"
+
+	rendererUsage = "Caption renderer. Valid values: capdec (headless browser), go (pure Go). Defaults to capdec if available, go needs a build with -tags nocapdec"
+
+	optOutUsage = "File listing users who opted out of captioning, e.g. the optout.list file of the bot"
+
 	shortcut = " (shortcut)"
 )
 
 var (
-	credsFlag      string
 	screenNameFlag string
 	tweetTypeFlag  string
-	outPathFlag    string
-	logFileFlag    string
 )
 
+// options hold the values of the flags of a command. Each job of a batch has
+// options of its own.
+type options struct {
+	creds       string
+	outPath     string
+	logFile     string
+	concurrency int
+	layout      string
+	runDir      string
+	job         string // Batch job, e.g. job2, added to the names of its files
+	noGallery   bool
+	pdf         bool
+	bundle      string
+	bundleOnly  bool
+
+	optOut        string
+	renderer      string
+	fullURLs      bool
+	styleEntities bool
+	metadata      string
+	timezone      string
+
+	cardWidth      int
+	cardBackground string
+	cardForeground string
+	cardHighlight  string
+
+	since      string
+	until      string
+	mediaOnly  bool
+	textOnly   bool
+	noRetweets bool
+	noReplies  bool
+	keywords   string
+	match      string
+	minLikes   int
+
+	max       int
+	tweetFile string
+	token     string
+}
+
 func main() {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -45,8 +105,46 @@ func main() {
 	}
 	outPathDef := filepath.Join(homeDir, "tweet_caption_bot")
 
-	flag.StringVar(&credsFlag, "creds", credsDef, credsUsage)
-	flag.StringVar(&credsFlag, "c", credsDef, credsUsage+shortcut)
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	// Flags without a command select tweets or favorites of a user as in
+	// earlier versions.
+	if strings.HasPrefix(os.Args[1], "-") {
+		runLegacy(outPathDef)
+		return
+	}
+
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "verify":
+		RunVerify(args, outPathDef)
+	case "recaption":
+		RunRecaption(args, outPathDef)
+	case "batch":
+		RunBatch(args, outPathDef)
+	case "gallery":
+		RunGallery(args)
+	case "pdf":
+		RunPDF(args)
+	case "help":
+		printUsage()
+	default:
+		cmd, ok := fetchCommands[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+			printUsage()
+			os.Exit(2)
+		}
+		runFetch(name, cmd, args, outPathDef)
+	}
+}
+
+// runLegacy runs the CLI with the flags of earlier versions, -type and
+// -screenName select the tweets to caption.
+func runLegacy(outPathDef string) {
+	o := &options{}
 
 	flag.StringVar(&screenNameFlag, "screenName", screenNameDef, screenNameUsageUsage)
 	flag.StringVar(&screenNameFlag, "s", screenNameDef, screenNameUsageUsage+shortcut)
@@ -54,66 +152,121 @@ func main() {
 	flag.StringVar(&tweetTypeFlag, "type", tweetTypeDef, tweetTypeUsage)
 	flag.StringVar(&tweetTypeFlag, "t", tweetTypeDef, tweetTypeUsage+shortcut)
 
-	flag.StringVar(&outPathFlag, "out", outPathDef, outPathDefUsage)
-	flag.StringVar(&outPathFlag, "o", outPathDef, outPathDefUsage+shortcut)
-
-	flag.StringVar(&logFileFlag, "log", logFileDef, logFileUsage)
-	flag.StringVar(&logFileFlag, "l", logFileDef, logFileUsage+shortcut)
+	registerCommonFlags(flag.CommandLine, o, outPathDef)
+	registerCaptionFlags(flag.CommandLine, o)
+	registerFilterFlags(flag.CommandLine, o)
 
 	flag.Parse()
 
-	logFilePath := filepath.Join(outPathFlag, logFileFlag)
-	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Panicf("Log file %v couldn't be created. Error message: %v", logFilePath, err)
+	name := "user"
+	if strings.Contains(strings.ToLower(tweetTypeFlag), "fav") {
+		name = "favs"
 	}
-	defer f.Close()
+	fetchAndCaption(fetchCommands[name], o, []string{screenNameFlag})
+}
 
-	creds, err := twigger.LoadCredentials(credsFlag)
-	if err != nil {
-		log.Panicf("Credentials file %v couldn't be loaded. Error message: %v", credsFlag, err)
-	}
+// registerCommonFlags defines the flags shared by the commands that caption
+// tweets.
+func registerCommonFlags(fs *flag.FlagSet, o *options, outPathDef string) {
+	fs.StringVar(&o.creds, "creds", credsDef, credsUsage)
+	fs.StringVar(&o.creds, "c", credsDef, credsUsage+shortcut)
 
-	finfo, err := os.Stat(outPathFlag)
-	if err != nil || finfo.IsDir() == false {
-		log.Panicf("Given output directory: %v is not valid!", err)
-	}
+	registerOutputFlags(fs, o, outPathDef)
+	fs.StringVar(&o.runDir, "run-dir", runDirDef, runDirUsage)
+}
 
-	bot := twcapbot.New(creds, f, []string{""}, outPathFlag)
-	twcapbot.SetBotScreenName(bot.TwiggerConn.User.ScreenName)
+// registerOutputFlags defines the flags that control where and how fast
+// captions are written.
+func registerOutputFlags(fs *flag.FlagSet, o *options, outPathDef string) {
+	fs.StringVar(&o.outPath, "out", outPathDef, outPathDefUsage)
+	fs.StringVar(&o.outPath, "o", outPathDef, outPathDefUsage+shortcut)
 
-	twiggerFunc := bot.TwiggerConn.GetAllRecentTweetsFromScreenName
-	tweetType := "tweets"
-	if strings.Contains(strings.ToLower(tweetTypeFlag), "fav") {
-		twiggerFunc = bot.TwiggerConn.GetAllRecentFavoritesFromScreenName
-		tweetType = "favorites"
-	}
+	fs.StringVar(&o.logFile, "log", logFileDef, logFileUsage)
+	fs.StringVar(&o.logFile, "l", logFileDef, logFileUsage+shortcut)
 
-	timeName := time.Now().Format("01_02_2006_15_04")
-	jsonFileName := fmt.Sprintf("%v_%v_%v.json", screenNameFlag, timeName, tweetType)
-	jsonFilePath := filepath.Join(bot.OutDirPath, jsonFileName)
+	registerRunFlags(fs, o)
+}
+
+// registerRunFlags defines the flags that control how fast captions are
+// written and what a run writes besides them.
+func registerRunFlags(fs *flag.FlagSet, o *options) {
+	fs.IntVar(&o.concurrency, "concurrency", concurrencyDef, concurrencyUsage)
+	fs.IntVar(&o.concurrency, "j", concurrencyDef, concurrencyUsage+shortcut)
 
-	tweets, err := twiggerFunc(screenNameFlag)
+	fs.StringVar(&o.layout, "layout", twcapbot.LayoutUser, layoutUsage)
+	fs.BoolVar(&o.noGallery, "no-gallery", false, noGalleryUsage)
+	fs.BoolVar(&o.pdf, "pdf", false, pdfUsage)
+	fs.StringVar(&o.bundle, "bundle", "", bundleUsage)
+	fs.BoolVar(&o.bundleOnly, "bundle-only", false, bundleOnlyUsage)
+}
+
+// openLog opens the log file in the output directory.
+func openLog(o *options) *os.File {
+	finfo, err := os.Stat(o.outPath)
+	if err != nil || finfo.IsDir() == false {
+		log.Panicf("Given output directory: %v is not valid!", o.outPath)
+	}
+
+	logFilePath := filepath.Join(o.outPath, o.logFile)
+	f, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		log.Printf("Retrieval of recent %v of user %v has failed!", tweetType, screenNameFlag)
-		log.Panicf("Error message: %v", err)
+		log.Panicf("Log file %v couldn't be created. Error message: %v", logFilePath, err)
 	}
+	return f
+}
 
-	err = tweets.Save(jsonFilePath)
-	bot.ErrLog.Printf("Saving of recent %v of user %v to %v has failed!", tweetType, screenNameFlag, jsonFilePath)
+// registerCaptionFlags defines the flags that control how captions look and
+// which tweets are captioned.
+func registerCaptionFlags(fs *flag.FlagSet, o *options) {
+	fs.StringVar(&o.optOut, "optout", "", optOutUsage)
 
-	twUserDirName := fmt.Sprintf("%v_%v_%v_%v",
-		bot.TwiggerConn.User.ScreenName, bot.TwiggerConn.User.Id, tweetType, timeName)
-	captionRootDir := filepath.Join(bot.OutDirPath, twUserDirName)
+	fs.StringVar(&o.renderer, "renderer", "", rendererUsage)
+	fs.BoolVar(&o.fullURLs, "full-urls", false, fullURLsUsage)
+	fs.BoolVar(&o.styleEntities, "style-entities", false, styleEntitiesUsage)
+	fs.StringVar(&o.metadata, "metadata", "", metadataUsage)
+	fs.StringVar(&o.timezone, "timezone", "UTC", timezoneUsage)
 
-	for i, tw := range tweets {
-		bot.InfoLog.Printf("Tweet captioning task %v/%v has started", i+1, len(tweets))
-		err := bot.CaptionTweet(tw.Id, captionRootDir)
+	fs.IntVar(&o.cardWidth, "card-width", cardWidthDef, cardWidthUsage)
+	fs.StringVar(&o.cardBackground, "card-background", "", cardBackgroundUsage)
+	fs.StringVar(&o.cardForeground, "card-foreground", "", cardForegroundUsage)
+	fs.StringVar(&o.cardHighlight, "card-highlight", "", cardHighlightUsage)
+}
+
+// configureBot applies the flags defined by registerCaptionFlags and the
+// layout to the bot.
+func configureBot(bot *twcapbot.TweetCaptionBot, o *options) {
+	var err error
+	bot.Renderer, err = twcapbot.NewRenderer(o.renderer, bot.JSCodes)
+	if err != nil {
+		log.Panicf("Renderer couldn't be created. Error message: %v", err)
+	}
+	bot.Captions = twcapbot.CaptionOptions{FullURLs: o.fullURLs, StyleEntities: o.styleEntities}
+	bot.Captions.Metadata, err = twcapbot.ParseMetadataFields(o.metadata)
+	if err != nil {
+		log.Panicf("Invalid metadata fields. Error message: %v", err)
+	}
+	bot.Captions.Metadata.Location, err = time.LoadLocation(o.timezone)
+	if err != nil {
+		log.Panicf("Invalid time zone %v. Error message: %v", o.timezone, err)
+	}
+	err = bot.Card.SetAppearance(o.cardWidth, o.cardBackground, o.cardForeground, o.cardHighlight)
+	if err != nil {
+		log.Panicf("Invalid tweet card options. Error message: %v", err)
+	}
+	bot.Layout, err = twcapbot.ParseLayout(o.layout, bot.Captions.Metadata.Location)
+	if err != nil {
+		log.Panicf("Invalid layout. Error message: %v", err)
+	}
+	// Runs of the process share the rate limits, page requests wait for
+	// them to reset and are repeated on their own.
+	bot.Throttle = func(request func() error) error {
+		return apiLimits.do(bot, request)
+	}
 
-		if err == nil {
-			bot.InfoLog.Printf("Tweet captioning task %v/%v has completed successfully", i+1, len(tweets))
-		} else {
-			bot.InfoLog.Printf("Tweet captioning task %v/%v has failed", i+1, len(tweets))
+	if o.optOut != "" {
+		bot.OptOuts, err = twcapbot.LoadOptOutList(o.optOut)
+		if err != nil {
+			log.Panicf("Opt-out list %v couldn't be loaded. Error message: %v", o.optOut, err)
 		}
 	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gusanmaz/twcapbot"
+	"github.com/gusanmaz/twigger"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const tweetsUsage = "JSON file of tweets saved by tweet-captioner-cli. Defaults to every .json file in the output directory"
+
+// RunVerify implements the verify subcommand which checks the provenance
+// embedded into caption images against the saved tweets. Images given as
+// arguments are checked, or every caption image in the output directory.
+func RunVerify(args []string, outPathDef string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	outPath := fs.String("out", outPathDef, outPathDefUsage)
+	fs.StringVar(outPath, "o", outPathDef, outPathDefUsage+shortcut)
+	tweetsPath := fs.String("tweets", "", tweetsUsage)
+	fs.Parse(args)
+
+	jsonPaths := []string{*tweetsPath}
+	if *tweetsPath == "" {
+		var err error
+		jsonPaths, err = filepath.Glob(filepath.Join(*outPath, "*.json"))
+		if err != nil {
+			log.Fatalf("Saved tweets couldn't be listed. Error message: %v", err)
+		}
+		saved := jsonPaths[:0]
+		for _, path := range jsonPaths {
+			if !strings.HasSuffix(path, batchSummarySuffix) {
+				saved = append(saved, path)
+			}
+		}
+		jsonPaths = saved
+	}
+	tweets := map[string]twigger.Tweet{}
+	for _, path := range jsonPaths {
+		saved, err := twcapbot.LoadSavedTweets(path)
+		if err != nil {
+			log.Fatalf("Saved tweets %v couldn't be loaded. Error message: %v", path, err)
+		}
+		for _, tw := range saved {
+			tweets[fmt.Sprint(tw.Id)] = tw
+		}
+	}
+
+	images := fs.Args()
+	if len(images) == 0 {
+		err := filepath.Walk(*outPath, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && strings.HasSuffix(path, "_caption.png") {
+				images = append(images, path)
+			}
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Caption images in %v couldn't be listed. Error message: %v", *outPath, err)
+		}
+	}
+
+	failed := 0
+	for _, path := range images {
+		problems := VerifyImage(path, tweets)
+		if len(problems) == 0 {
+			fmt.Printf("OK    %v\n", path)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %v: %v\n", path, strings.Join(problems, "; "))
+	}
+	fmt.Printf("%v images verified, %v failed\n", len(images), failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// VerifyImage returns the problems found with the provenance of the image.
+func VerifyImage(path string, tweets map[string]twigger.Tweet) []string {
+	p, err := twcapbot.ReadProvenance(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	problems := []string{}
+	tw, ok := tweets[p.TweetID]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("tweet %v is not among the saved tweets", p.TweetID))
+	} else {
+		if !strings.EqualFold(tw.User.ScreenName, p.Author) {
+			problems = append(problems, fmt.Sprintf("author is @%v, saved tweet is by @%v", p.Author, tw.User.ScreenName))
+		}
+		if url := twcapbot.GetTweetURL(tw); url != p.URL {
+			problems = append(problems, fmt.Sprintf("URL is %v, saved tweet has %v", p.URL, url))
+		}
+	}
+
+	if p.MediaSHA256 != "" {
+		mediaPath := filepath.Join(filepath.Dir(path), filepath.FromSlash(p.MediaFile))
+		sum, err := twcapbot.FileSHA256(mediaPath)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("original media couldn't be read: %v", err))
+		} else if sum != p.MediaSHA256 {
+			problems = append(problems, fmt.Sprintf("original media %v has changed", p.MediaFile))
+		}
+	}
+	return problems
+}
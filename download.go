@@ -3,6 +3,7 @@ package twcapbot
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -28,16 +29,27 @@ func DownloadTo(url, path string) error {
 		return errors.New("Received non 200 response code")
 	}
 
-	file, err := os.Create(path)
+	return writeFileAtomic(path, resp.Body)
+}
+
+// writeFileAtomic writes the file through a temporary file renamed to path,
+// so that tweets sharing a media file never read it half written.
+func writeFileAtomic(path string, r io.Reader) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	_, err = io.Copy(file, resp.Body)
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
 	if err != nil {
-		return err
+		os.Remove(file.Name())
 	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,81 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CaptionOptions controls how tweet texts appear in captions.
+type CaptionOptions struct {
+	FullURLs      bool // Show expanded URLs instead of the abbreviated ones Twitter displays
+	StyleEntities bool // Highlight mentions and hashtags
+
+	Metadata MetadataOptions
+}
+
+// HighlightColor is the color of mentions and hashtags in styled captions.
+const HighlightColor = "#1d9bf0"
+
+var entityRegex = regexp.MustCompile(`[@#][\p{L}\p{M}\p{N}_]+`)
+
+// EntityTokens returns the mentions and hashtags Twitter recognised in the
+// tweet, lower-cased and prefixed with @ or #.
+func EntityTokens(tw twigger.Tweet) map[string]bool {
+	tokens := map[string]bool{}
+	for _, m := range tw.Entities.User_mentions {
+		tokens["@"+strings.ToLower(m.Screen_name)] = true
+	}
+	for _, h := range tw.Entities.Hashtags {
+		tokens["#"+strings.ToLower(h.Text)] = true
+	}
+	return tokens
+}
+
+// findEntities returns the byte ranges of the mentions and hashtags of text
+// that are listed in tokens.
+func findEntities(text string, tokens map[string]bool) [][]int {
+	found := [][]int{}
+	if len(tokens) == 0 {
+		return found
+	}
+	for _, loc := range entityRegex.FindAllStringIndex(text, -1) {
+		if loc[0] > 0 {
+			prev, _ := utf8.DecodeLastRuneInString(text[:loc[0]])
+			if prev == '_' || unicode.IsLetter(prev) || unicode.IsNumber(prev) {
+				continue
+			}
+		}
+		if tokens[strings.ToLower(text[loc[0]:loc[1]])] {
+			found = append(found, loc)
+		}
+	}
+	return found
+}
+
+// NewStyledTextCaption returns a caption for plain text like NewTextCaption
+// with the mentions and hashtags listed in tokens highlighted.
+func NewStyledTextCaption(label, text, lang string, tokens map[string]bool) Caption {
+	// Ranges refer to the text as renderers read it back from the caption.
+	text = PlainCaption(EscapeCaptionText(text))
+	c := NewTextCaption(label, text, lang)
+	ranges := findEntities(text, tokens)
+	if len(ranges) == 0 {
+		return c
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, r := range ranges {
+		b.WriteString(EscapeCaptionText(text[last:r[0]]))
+		b.WriteString(fmt.Sprintf(`<span style="color:%v">%v</span>`, HighlightColor, EscapeCaptionText(text[r[0]:r[1]])))
+		last = r[1]
+	}
+	c.Highlights = ranges
+	b.WriteString(EscapeCaptionText(text[last:]))
+	c.Text = b.String()
+	return c
+}
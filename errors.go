@@ -0,0 +1,98 @@
+package twcapbot
+
+import (
+	"errors"
+	"github.com/ChimeraCoder/anaconda"
+	"net"
+	"time"
+)
+
+// permanentError is an error of this package that retrying won't fix.
+type permanentError struct {
+	msg string
+}
+
+func (e permanentError) Error() string {
+	return e.msg
+}
+
+func (e permanentError) Permanent() bool {
+	return true
+}
+
+var (
+	ErrTweetUnavailable = permanentError{"tweet is deleted or not available"}
+	ErrProtectedAccount = permanentError{"author of the tweet has a protected account"}
+	ErrOptedOut         = permanentError{"author of the tweet has opted out of captioning"}
+	ErrMediaNotFound    = permanentError{"media file of the tweet is not saved locally"}
+	ErrInvalidTweetID   = permanentError{"not a tweet ID or URL"}
+)
+
+// Twitter error codes that won't go away by retrying the same request.
+var permanentTwitterCodes = map[int]bool{
+	anaconda.TwitterErrorDoesNotExist:       true,
+	anaconda.TwitterErrorDoesNotExist2:      true,
+	anaconda.TwitterErrorAccountSuspended:   true,
+	anaconda.TwitterErrorStatusIsADuplicate: true,
+	63:                                      true, // User has been suspended
+	136:                                     true, // Blocked by the author
+	179:                                     true, // Not authorized to see the status
+	385:                                     true, // Replied tweet is deleted or not visible
+	433:                                     true, // Replies are restricted by the author
+}
+
+// IsPermanentError reports whether the operation that produced err is
+// pointless to retry. Unknown errors are assumed to be transient.
+func IsPermanentError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var p interface{ Permanent() bool }
+	if errors.As(err, &p) {
+		return p.Permanent()
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return false
+	}
+
+	apiErr := asAPIError(err)
+	if apiErr == nil {
+		return false
+	}
+	for _, e := range apiErr.Decoded.Errors {
+		if permanentTwitterCodes[e.Code] {
+			return true
+		}
+	}
+	switch apiErr.StatusCode {
+	case 400, 401, 403, 404, 410:
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns the earliest time a request rejected by Twitter's rate
+// limiter could be retried.
+func RetryAfter(err error) (time.Time, bool) {
+	apiErr := asAPIError(err)
+	if apiErr == nil {
+		return time.Time{}, false
+	}
+	limited, next := apiErr.RateLimitCheck()
+	return next, limited
+}
+
+func asAPIError(err error) *anaconda.ApiError {
+	var ptr *anaconda.ApiError
+	if errors.As(err, &ptr) {
+		return ptr
+	}
+	var val anaconda.ApiError
+	if errors.As(err, &val) {
+		return &val
+	}
+	return nil
+}
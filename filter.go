@@ -0,0 +1,82 @@
+package twcapbot
+
+import (
+	"github.com/gusanmaz/twigger"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TweetFilter selects the tweets worth captioning. Zero fields don't filter.
+// Retweets are judged by the retweeted tweet except for their creation time,
+// which is the time they are retweeted.
+type TweetFilter struct {
+	Since time.Time // Tweets created before are left out
+	Until time.Time // Tweets created at or after are left out
+
+	MediaOnly       bool
+	TextOnly        bool // Tweets without media only
+	ExcludeRetweets bool
+	ExcludeReplies  bool
+
+	// Tweet text must contain one of the keywords, case insensitively, and
+	// match Pattern. Links are matched in full.
+	Keywords []string
+	Pattern  *regexp.Regexp
+
+	MinLikes int
+}
+
+// Match reports whether the tweet passes the filter.
+func (f TweetFilter) Match(tw twigger.Tweet) bool {
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		created, err := time.Parse(time.RubyDate, tw.CreatedAt)
+		if err != nil {
+			return false
+		}
+		if !f.Since.IsZero() && created.Before(f.Since) {
+			return false
+		}
+		if !f.Until.IsZero() && !created.Before(f.Until) {
+			return false
+		}
+	}
+	if f.ExcludeRetweets && tw.RetweetedStatus != nil {
+		return false
+	}
+	if f.ExcludeReplies && tw.InReplyToStatusID != 0 {
+		return false
+	}
+
+	content := tw
+	if tw.RetweetedStatus != nil {
+		content = twigger.Tweet(*tw.RetweetedStatus)
+	}
+	hasMedia := len(content.GetMediaURLs()) > 0
+	if f.MediaOnly && !hasMedia || f.TextOnly && hasMedia {
+		return false
+	}
+	if content.FavoriteCount < f.MinLikes {
+		return false
+	}
+
+	if len(f.Keywords) > 0 || f.Pattern != nil {
+		text := ExpandTweetText(content, true)
+		if len(f.Keywords) > 0 && !containsAny(strings.ToLower(text), f.Keywords) {
+			return false
+		}
+		if f.Pattern != nil && !f.Pattern.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAny(text string, keywords []string) bool {
+	for _, k := range keywords {
+		if strings.Contains(text, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,451 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"html/template"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GalleryIndexFile = "index.html"
+	galleryTweetDir  = "tweets"
+	galleryThumbDir  = "thumbs"
+
+	galleryDateLayout = "2006-01-02"
+	galleryExcerpt    = 140 // Characters of tweet text shown on the index
+)
+
+// GalleryOptions configure the static HTML gallery of a run.
+type GalleryOptions struct {
+	Title      string
+	PageSize   int            // Thumbnails per page, defaults to 48
+	ThumbWidth int            // Defaults to 320 pixels
+	Location   *time.Location // Time zone of shown times, nil means UTC
+	Layout     Layout         // Layout of the run, PerUserLayout if nil
+}
+
+// galleryEntry is a captioned tweet on the gallery. Paths are relative to
+// the root of the run and use slashes.
+type galleryEntry struct {
+	ID         string
+	URL        string
+	Name       string
+	ScreenName string
+	Text       string
+	Lang       string
+	Dir        string
+	Date       string // Creation day, used by the date filter
+	Time       string
+	Created    time.Time
+	Likes      int
+	Retweets   int
+	Types      string // Space separated: media or text, quote, reply, retweet
+
+	Captions []string
+	Media    []string
+	Thumb    string
+	Page     string
+	Prev     string
+	Next     string
+}
+
+// Excerpt returns the start of the tweet text.
+func (e galleryEntry) Excerpt() string {
+	return TruncateText(e.Text, galleryExcerpt)
+}
+
+// SearchText returns the lower case text the search box matches against.
+func (e galleryEntry) SearchText() string {
+	return strings.ToLower(e.Text + " " + e.Name + " @" + e.ScreenName)
+}
+
+// Gallery is a static HTML gallery of the tweets captioned under a root
+// directory: an index page with thumbnails that can be searched, filtered by
+// date and type and paged through, and a page per tweet showing its caption
+// images, original media and text. The gallery needs no server and works from
+// file:// URLs. Tweets are added as they are captioned and the pages are
+// written at the end, so caption images may be removed once their tweet is
+// added. It is safe for concurrent use.
+type Gallery struct {
+	rootPath string
+	opts     GalleryOptions
+
+	mu      sync.Mutex
+	entries []galleryEntry
+	seen    map[int64]bool
+}
+
+// NewGallery returns an empty gallery of the tweets under rootPath.
+func NewGallery(rootPath string, opts GalleryOptions) (*Gallery, error) {
+	if opts.PageSize <= 0 {
+		opts.PageSize = 48
+	}
+	if opts.ThumbWidth <= 0 {
+		opts.ThumbWidth = 320
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.Layout == nil {
+		opts.Layout = PerUserLayout{}
+	}
+
+	for _, dir := range []string{galleryTweetDir, galleryThumbDir} {
+		err := os.MkdirAll(filepath.Join(rootPath, dir), 0750)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Gallery{rootPath: rootPath, opts: opts, seen: map[int64]bool{}}, nil
+}
+
+// Add adds a captioned tweet to the gallery and writes its thumbnail. Tweets
+// without caption images under the root directory are left out, ok is false
+// for them.
+func (g *Gallery) Add(tw twigger.Tweet) (ok bool, err error) {
+	g.mu.Lock()
+	if g.seen[tw.Id] {
+		g.mu.Unlock()
+		return true, nil
+	}
+	g.seen[tw.Id] = true
+	g.mu.Unlock()
+
+	e, ok := newGalleryEntry(g.rootPath, tw, g.opts)
+	if !ok {
+		return false, nil
+	}
+	err = writeGalleryThumb(g.rootPath, e, g.opts.ThumbWidth)
+	if err != nil {
+		return false, fmt.Errorf("thumbnail of tweet %v: %w", e.ID, err)
+	}
+
+	g.mu.Lock()
+	g.entries = append(g.entries, e)
+	g.mu.Unlock()
+	return true, nil
+}
+
+// Write writes the index and tweet pages and returns the number of tweets
+// in the gallery.
+func (g *Gallery) Write() (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	entries := g.entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.After(entries[j].Created)
+	})
+	for i := range entries {
+		entries[i].Prev, entries[i].Next = "", ""
+		if i > 0 {
+			entries[i].Prev = entries[i-1].ID
+		}
+		if i+1 < len(entries) {
+			entries[i].Next = entries[i+1].ID
+		}
+	}
+
+	for _, e := range entries {
+		err := writeTemplate(filepath.Join(g.rootPath, filepath.FromSlash(e.Page)), galleryTweetTemplate, struct {
+			Title string
+			galleryEntry
+		}{g.opts.Title, e})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := writeTemplate(filepath.Join(g.rootPath, GalleryIndexFile), galleryIndexTemplate, struct {
+		Title     string
+		Generated string
+		PageSize  int
+		Entries   []galleryEntry
+	}{g.opts.Title, time.Now().In(g.opts.Location).Format(DefaultMetadataTimeLayout), g.opts.PageSize, entries})
+	return len(entries), err
+}
+
+// Files returns the paths of the files of the gallery relative to the root
+// directory.
+func (g *Gallery) Files() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	files := []string{GalleryIndexFile}
+	for _, e := range g.entries {
+		files = append(files, e.Page, e.Thumb)
+	}
+	return files
+}
+
+// WriteGallery writes the gallery of the tweets captioned under rootPath,
+// see Gallery. It returns the number of tweets in the gallery.
+func WriteGallery(rootPath string, tweets twigger.Tweets, opts GalleryOptions) (int, error) {
+	g, err := NewGallery(rootPath, opts)
+	if err != nil {
+		return 0, err
+	}
+	for _, tw := range tweets {
+		_, err := g.Add(tw)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return g.Write()
+}
+
+// newGalleryEntry returns the gallery entry of the tweet. ok is false if the
+// tweet has no caption image under rootPath.
+func newGalleryEntry(rootPath string, tw twigger.Tweet, opts GalleryOptions) (e galleryEntry, ok bool) {
+	files := TweetFiles(rootPath, tw, opts.Layout)
+	if len(files) == 0 {
+		return e, false
+	}
+
+	e = galleryEntry{
+		ID:         tw.IdStr,
+		URL:        GetTweetURL(tw),
+		Name:       tw.User.Name,
+		ScreenName: tw.User.ScreenName,
+		Text:       TweetText(tw),
+		Lang:       TweetLanguage(tw.Lang),
+		Likes:      tw.FavoriteCount,
+		Retweets:   tw.RetweetCount,
+	}
+	if e.ID == "" {
+		e.ID = fmt.Sprint(tw.Id)
+	}
+	e.Thumb = galleryThumbDir + "/" + e.ID + ".jpg"
+	e.Page = galleryTweetDir + "/" + e.ID + ".html"
+	e.Dir = TextDirection(e.Text, tw.Lang)
+	e.Created, _ = time.Parse(time.RubyDate, tw.CreatedAt)
+	if !e.Created.IsZero() {
+		e.Date = e.Created.In(opts.Location).Format(galleryDateLayout)
+		e.Time = e.Created.In(opts.Location).Format(DefaultMetadataTimeLayout)
+	}
+
+	types := []string{"text"}
+	for _, f := range files {
+		e.Captions = append(e.Captions, filepath.ToSlash(f.Caption))
+		if f.Media != "" {
+			e.Media = append(e.Media, filepath.ToSlash(f.Media))
+			types[0] = "media"
+		}
+	}
+	if tw.QuotedStatusID != 0 {
+		types = append(types, "quote")
+	}
+	if tw.InReplyToStatusID != 0 {
+		types = append(types, "reply")
+	}
+	if tw.RetweetedStatus != nil {
+		types = append(types, "retweet")
+	}
+	e.Types = strings.Join(types, " ")
+	return e, true
+}
+
+// TweetFiles returns the paths of the files written for a tweet captioned
+// under rootPath with the given layout, relative to rootPath. Files that
+// don't exist are left out: Media and HTML are emptied if their files are
+// missing and nothing is returned without caption images. The names used
+// with and without the quoted tweet are tried, as the quoted tweet may not
+// have been available when the tweet was captioned.
+func TweetFiles(rootPath string, tw twigger.Tweet, layout Layout) []TweetFilePaths {
+	candidates := [][]TweetFileNameInfo{GenerateFileNamesForTweet(tw, nil)}
+	if tw.QuotedStatus != nil {
+		qt := twigger.Tweet(*tw.QuotedStatus)
+		candidates = append([][]TweetFileNameInfo{GenerateFileNamesForTweet(tw, &qt)}, candidates...)
+	}
+
+	for _, infos := range candidates {
+		files := []TweetFilePaths{}
+		for _, v := range infos {
+			paths := layout.Paths(tw, v)
+			if !fileExists(filepath.Join(rootPath, paths.Caption)) {
+				continue
+			}
+			if !v.MediaTweet || !fileExists(filepath.Join(rootPath, paths.Media)) {
+				paths.Media = ""
+			}
+			if !fileExists(filepath.Join(rootPath, paths.HTML)) {
+				paths.HTML = ""
+			}
+			files = append(files, paths)
+		}
+		if len(files) > 0 {
+			return files
+		}
+	}
+	return nil
+}
+
+func writeGalleryThumb(rootPath string, e galleryEntry, width int) error {
+	f, err := os.Open(filepath.Join(rootPath, filepath.FromSlash(e.Captions[0])))
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	scale := float64(width) / float64(img.Bounds().Dx())
+	if scale > 1 {
+		scale = 1
+	}
+	return writeScaledJPEG(img, scale, filepath.Join(rootPath, filepath.FromSlash(e.Thumb)))
+}
+
+func writeTemplate(path string, t *template.Template, data interface{}) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = t.Execute(f, data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func fileExists(path string) bool {
+	finfo, err := os.Stat(path)
+	return err == nil && !finfo.IsDir()
+}
+
+const galleryStyle = `
+body { margin: 0; font-family: system-ui, -apple-system, "Segoe UI", sans-serif; color: #0f1419; background: #f7f9f9; }
+header, main, nav, article { max-width: 1200px; margin: 0 auto; padding: 16px; }
+header h1 { margin: 0 0 4px; font-size: 24px; }
+.muted { color: #536471; }
+form { display: flex; flex-wrap: wrap; gap: 8px; margin-top: 12px; }
+input, select, button { font: inherit; padding: 6px 10px; border: 1px solid #cfd9de; border-radius: 6px; background: #fff; }
+#grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(220px, 1fr)); gap: 16px; }
+.item { display: flex; flex-direction: column; background: #fff; border: 1px solid #cfd9de; border-radius: 12px; overflow: hidden; color: inherit; text-decoration: none; }
+.item:hover { border-color: #1d9bf0; }
+.item img { width: 100%; height: 220px; object-fit: cover; object-position: top; background: #eff3f4; }
+.item .meta, .item .text { padding: 6px 10px; font-size: 14px; }
+.item .text { padding-top: 0; overflow-wrap: anywhere; }
+nav { display: flex; gap: 12px; align-items: center; justify-content: center; }
+a { color: #1d9bf0; }
+article .text { white-space: pre-wrap; font-size: 18px; overflow-wrap: anywhere; }
+article img { display: block; max-width: 100%; margin: 12px 0; border: 1px solid #cfd9de; border-radius: 12px; }
+`
+
+var galleryIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>` + galleryStyle + `</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<div class="muted">{{len .Entries}} tweets, generated {{.Generated}}</div>
+<form onsubmit="return false">
+<input type="search" id="query" placeholder="Search text or author">
+<select id="type">
+<option value="">All tweets</option>
+<option value="media">With media</option>
+<option value="text">Text only</option>
+<option value="quote">Quotes</option>
+<option value="reply">Replies</option>
+<option value="retweet">Retweets</option>
+</select>
+<label class="muted">From <input type="date" id="from"></label>
+<label class="muted">To <input type="date" id="to"></label>
+<span class="muted" id="count"></span>
+</form>
+</header>
+<main id="grid">
+{{range .Entries}}<a class="item" href="{{.Page}}" data-date="{{.Date}}" data-types="{{.Types}}" data-search="{{.SearchText}}">
+<img src="{{.Thumb}}" alt="Captioned tweet {{.ID}}" loading="lazy">
+<span class="meta"><b>@{{.ScreenName}}</b> <span class="muted">{{.Date}}</span></span>
+<span class="text" dir="{{.Dir}}">{{.Excerpt}}</span>
+</a>
+{{end}}</main>
+<nav>
+<button id="prev" type="button">Previous</button>
+<span id="page" class="muted"></span>
+<button id="next" type="button">Next</button>
+</nav>
+<script>
+(function () {
+	var pageSize = {{.PageSize}};
+	var items = Array.prototype.slice.call(document.querySelectorAll(".item"));
+	var page = 0, matched = items;
+	function value(id) { return document.getElementById(id).value; }
+	function filter() {
+		var query = value("query").toLowerCase(), type = value("type");
+		var from = value("from"), to = value("to");
+		matched = items.filter(function (el) {
+			var d = el.getAttribute("data-date");
+			if (query && el.getAttribute("data-search").indexOf(query) < 0) return false;
+			if (type && (" " + el.getAttribute("data-types") + " ").indexOf(" " + type + " ") < 0) return false;
+			if (from && (!d || d < from)) return false;
+			if (to && (!d || d > to)) return false;
+			return true;
+		});
+		page = 0;
+		show();
+	}
+	function show() {
+		var pages = Math.max(1, Math.ceil(matched.length / pageSize));
+		page = Math.min(Math.max(page, 0), pages - 1);
+		items.forEach(function (el) { el.style.display = "none"; });
+		matched.slice(page * pageSize, (page + 1) * pageSize).forEach(function (el) { el.style.display = ""; });
+		document.getElementById("page").textContent = "Page " + (page + 1) + " of " + pages;
+		document.getElementById("count").textContent = matched.length + " shown";
+		document.getElementById("prev").disabled = page === 0;
+		document.getElementById("next").disabled = page >= pages - 1;
+	}
+	["query", "type", "from", "to"].forEach(function (id) {
+		document.getElementById(id).addEventListener("input", filter);
+	});
+	document.getElementById("prev").addEventListener("click", function () { page--; show(); window.scrollTo(0, 0); });
+	document.getElementById("next").addEventListener("click", function () { page++; show(); window.scrollTo(0, 0); });
+	show();
+})();
+</script>
+</body>
+</html>
+`))
+
+var galleryTweetTemplate = template.Must(template.New("tweet").Funcs(template.FuncMap{
+	"up": func(path string) string { return "../" + path },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>@{{.ScreenName}} {{.ID}} - {{.Title}}</title>
+<style>` + galleryStyle + `</style>
+</head>
+<body>
+<nav>
+<a href="../` + GalleryIndexFile + `">All tweets</a>
+{{if .Prev}}<a href="{{.Prev}}.html">Newer</a>{{end}}
+{{if .Next}}<a href="{{.Next}}.html">Older</a>{{end}}
+</nav>
+<article>
+<h1>{{.Name}} <span class="muted">@{{.ScreenName}}</span></h1>
+<p class="text" dir="{{.Dir}}"{{if .Lang}} lang="{{.Lang}}"{{end}}>{{.Text}}</p>
+<p class="muted">{{.Time}} · {{.Likes}} likes · {{.Retweets}} retweets · <a href="{{.URL}}">View on Twitter</a></p>
+<h2>Captioned {{if gt (len .Captions) 1}}images{{else}}image{{end}}</h2>
+{{range .Captions}}<a href="{{up .}}"><img src="{{up .}}" alt="Captioned tweet"></a>
+{{end}}{{if .Media}}<h2>Original media</h2>
+{{range .Media}}<a href="{{up .}}"><img src="{{up .}}" alt="Original media"></a>
+{{end}}{{end}}</article>
+</body>
+</html>
+`))
@@ -3,8 +3,12 @@ module github.com/gusanmaz/twcapbot
 go 1.16
 
 require (
+	github.com/ChimeraCoder/anaconda v2.0.0+incompatible
+	github.com/garyburd/go-oauth v0.0.0-20180319155456-bca2e7f09a17
 	github.com/gusanmaz/capdec v0.1.5
 	github.com/gusanmaz/twigger v0.4.0
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/text v0.3.6
 )
 
 //replace github.com/gusanmaz/capdec => ../capdec
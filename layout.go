@@ -0,0 +1,163 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the layouts accepted by ParseLayout.
+const (
+	LayoutUser  = "user"
+	LayoutFlat  = "flat"
+	LayoutDate  = "date"
+	LayoutSplit = "split"
+
+	layoutDateFormat = "2006-01-02"
+	undatedDirName   = "undated"
+)
+
+// TweetFilePaths are the paths of the files written for a media file of a
+// tweet, or for a tweet without media, relative to the root of a run.
+type TweetFilePaths struct {
+	Media   string // Original media, empty for tweets without media
+	Caption string
+	HTML    string // Page redirecting to the tweet, shared by all media of a tweet
+}
+
+// Layout decides where the files of captioned tweets are written.
+type Layout interface {
+	// Paths returns the paths of the files written for v, one of the file
+	// names GenerateFileNamesForTweet returns for tw.
+	Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths
+}
+
+// ParseLayout returns the layout with the given name. Any other value
+// containing {tweet_id} is taken as the pattern of a TemplateLayout. Dates
+// are in loc, nil means UTC.
+func ParseLayout(s string, loc *time.Location) (Layout, error) {
+	switch s {
+	case "", LayoutUser:
+		return PerUserLayout{}, nil
+	case LayoutFlat:
+		return FlatLayout{}, nil
+	case LayoutDate:
+		return PerDateLayout{Location: loc}, nil
+	case LayoutSplit:
+		return SplitLayout{}, nil
+	}
+	if !strings.Contains(s, "{tweet_id}") {
+		return nil, fmt.Errorf("unknown layout %q, valid values: %v, %v, %v, %v or a pattern containing {tweet_id}",
+			s, LayoutUser, LayoutFlat, LayoutDate, LayoutSplit)
+	}
+	return TemplateLayout{Pattern: s, Location: loc}, nil
+}
+
+// PerUserLayout puts the files of each author into a directory of their
+// own. It is the default layout.
+type PerUserLayout struct{}
+
+func (PerUserLayout) Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths {
+	return longPaths(v.ShortDirName, v)
+}
+
+// FlatLayout puts all files into the root directory.
+type FlatLayout struct{}
+
+func (FlatLayout) Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths {
+	return longPaths("", v)
+}
+
+// PerDateLayout puts the files of tweets created on the same day into a
+// directory named after the day.
+type PerDateLayout struct {
+	Location *time.Location // nil means UTC
+}
+
+func (l PerDateLayout) Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths {
+	dir := undatedDirName
+	if created, err := time.Parse(time.RubyDate, tw.CreatedAt); err == nil {
+		dir = created.In(location(l.Location)).Format(layoutDateFormat)
+	}
+	return longPaths(dir, v)
+}
+
+// SplitLayout keeps original media and captions of each author apart, in
+// directories named after the author and suffixed with _caption
+// respectively. Files are named after the tweet only.
+type SplitLayout struct{}
+
+func (SplitLayout) Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths {
+	p := TweetFilePaths{
+		Caption: filepath.Join(v.ShortCaptionDirName, v.ShortCaptionFileName),
+		HTML:    filepath.Join(v.ShortCaptionDirName, v.ShortHTMLFileName),
+	}
+	if v.MediaTweet {
+		p.Media = filepath.Join(v.ShortDirName, v.ShortFileName)
+	}
+	return p
+}
+
+// TemplateLayout names files after a pattern. The pattern gives the path of
+// a tweet's files without suffixes; _<media ID>.png, _<media ID>_caption.png,
+// _caption.png for tweets without media and .html are appended. Slashes in
+// the pattern separate directories. Placeholders:
+//
+//	{tweet_id}     ID of the tweet, required
+//	{user_id}      ID of the author
+//	{screen_name}  Screen name of the author
+//	{user}         {user_id}_{screen_name}
+//	{date}         Creation day of the tweet as 2006-01-02
+//	{year}, {month}, {day}
+//
+// PerUserLayout is equivalent to {user}/{user}_{tweet_id}.
+type TemplateLayout struct {
+	Pattern  string
+	Location *time.Location // Time zone of dates, nil means UTC
+}
+
+func (l TemplateLayout) Paths(tw twigger.Tweet, v TweetFileNameInfo) TweetFilePaths {
+	date, year, month, day := undatedDirName, undatedDirName, undatedDirName, undatedDirName
+	if created, err := time.Parse(time.RubyDate, tw.CreatedAt); err == nil {
+		created = created.In(location(l.Location))
+		date, year, month, day = created.Format(layoutDateFormat), created.Format("2006"), created.Format("01"), created.Format("02")
+	}
+	base := strings.NewReplacer(
+		"{tweet_id}", fmt.Sprint(tw.Id),
+		"{user_id}", fmt.Sprint(tw.User.Id),
+		"{screen_name}", tw.User.ScreenName,
+		"{user}", fmt.Sprintf("%v_%v", tw.User.Id, tw.User.ScreenName),
+		"{date}", date,
+		"{year}", year,
+		"{month}", month,
+		"{day}", day,
+	).Replace(l.Pattern)
+	base = filepath.FromSlash(base)
+
+	p := TweetFilePaths{Caption: base + "_caption.png", HTML: base + ".html"}
+	if v.MediaTweet {
+		p.Media = fmt.Sprintf("%v_%v.png", base, v.MediaName)
+		p.Caption = fmt.Sprintf("%v_%v_caption.png", base, v.MediaName)
+	}
+	return p
+}
+
+func longPaths(dir string, v TweetFileNameInfo) TweetFilePaths {
+	p := TweetFilePaths{
+		Caption: filepath.Join(dir, v.LongCaptionFileName),
+		HTML:    filepath.Join(dir, v.LongHTMLFileName),
+	}
+	if v.MediaTweet {
+		p.Media = filepath.Join(dir, v.LongFileName)
+	}
+	return p
+}
+
+func location(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
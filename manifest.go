@@ -0,0 +1,198 @@
+package twcapbot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// ManifestFileName is the name of the manifest in the directory of a run.
+	ManifestFileName = "manifest.json"
+
+	TweetCaptioned = "captioned"
+	TweetSkipped   = "skipped" // Left out by filters, opted out, protected or deleted
+	TweetFailed    = "failed"
+
+	FileMedia   = "media"
+	FileCaption = "caption"
+	FileHTML    = "html"
+)
+
+// Manifest indexes the outputs of a run so that tools can consume archives
+// without knowing their layout. Paths are relative to the directory of the
+// run and use slashes. It is safe for concurrent use.
+type Manifest struct {
+	Software   string         `json:"software"`
+	Run        string         `json:"run"` // Name of the run directory
+	Collection string         `json:"collection,omitempty"`
+	Kind       string         `json:"kind,omitempty"`
+	Layout     string         `json:"layout,omitempty"`
+	CapturedAt time.Time      `json:"capturedAt"` // Time the tweets were retrieved
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt time.Time      `json:"finishedAt"`
+	DurationMs int64          `json:"durationMs"`
+	Counts     map[string]int `json:"counts"` // Tweets by status
+
+	// TweetsFile is the JSON file of the tweets. It is saved next to the
+	// run directory, bundles hold it in their root.
+	TweetsFile *ManifestFile   `json:"tweetsFile,omitempty"`
+	Tweets     []ManifestTweet `json:"tweets"`
+
+	mu    sync.Mutex
+	index map[int64]int
+}
+
+// ManifestTweet is the outcome of a tweet of a run.
+type ManifestTweet struct {
+	ID         string         `json:"id"`
+	ScreenName string         `json:"screenName"`
+	Status     string         `json:"status"`
+	Reason     string         `json:"reason,omitempty"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	DurationMs int64          `json:"durationMs"`
+	Files      []ManifestFile `json:"files,omitempty"`
+}
+
+// ManifestFile is a file of a run.
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Role   string `json:"role,omitempty"` // FileMedia, FileCaption or FileHTML
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewManifest returns the manifest of a run writing into the directory
+// rootPath, listing the tweets as skipped until they are captioned.
+func NewManifest(rootPath string, tweets twigger.Tweets) *Manifest {
+	m := &Manifest{
+		Software:  "twcapbot " + Version,
+		Run:       filepath.Base(rootPath),
+		StartedAt: time.Now().UTC(),
+		Tweets:    []ManifestTweet{},
+		index:     map[int64]int{},
+	}
+	for _, tw := range tweets {
+		if _, ok := m.index[tw.Id]; ok {
+			continue
+		}
+		m.index[tw.Id] = len(m.Tweets)
+		m.Tweets = append(m.Tweets, ManifestTweet{ID: fmt.Sprint(tw.Id), ScreenName: tw.User.ScreenName, Status: TweetSkipped})
+	}
+	return m
+}
+
+// Skip records that a tweet is not captioned for the reason given.
+func (m *Manifest) Skip(tw twigger.Tweet, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t := m.tweet(tw); t != nil {
+		t.Status, t.Reason = TweetSkipped, reason
+	}
+}
+
+// Record records the outcome of captioning a tweet that started at start.
+// err is the error captioning returned. Files of captioned tweets are listed
+// with their checksums, see TweetFiles. Tweets whose files cannot be read
+// are recorded as failed.
+func (m *Manifest) Record(rootPath string, tw twigger.Tweet, layout Layout, start time.Time, err error) {
+	finish := time.Now()
+	start, finish = start.UTC(), finish.UTC()
+
+	files := []ManifestFile{}
+	if err == nil {
+		files, err = manifestFiles(rootPath, tw, layout)
+	}
+	status, reason := TweetStatus(err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := m.tweet(tw)
+	if t == nil {
+		m.index[tw.Id] = len(m.Tweets)
+		m.Tweets = append(m.Tweets, ManifestTweet{ID: fmt.Sprint(tw.Id), ScreenName: tw.User.ScreenName})
+		t = &m.Tweets[len(m.Tweets)-1]
+	}
+	t.Status, t.Reason, t.Files = status, reason, files
+	t.StartedAt, t.FinishedAt = &start, &finish
+	t.DurationMs = finish.Sub(start).Milliseconds()
+}
+
+// Write completes the manifest and writes it to path.
+func (m *Manifest) Write(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.FinishedAt = time.Now().UTC()
+	m.DurationMs = m.FinishedAt.Sub(m.StartedAt).Milliseconds()
+	m.Counts = map[string]int{TweetCaptioned: 0, TweetSkipped: 0, TweetFailed: 0}
+	for _, t := range m.Tweets {
+		m.Counts[t.Status]++
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (m *Manifest) tweet(tw twigger.Tweet) *ManifestTweet {
+	if i, ok := m.index[tw.Id]; ok {
+		return &m.Tweets[i]
+	}
+	return nil
+}
+
+func manifestFiles(rootPath string, tw twigger.Tweet, layout Layout) ([]ManifestFile, error) {
+	files := []ManifestFile{}
+	for _, paths := range TweetFiles(rootPath, tw, layout) {
+		for _, f := range [][2]string{{paths.Media, FileMedia}, {paths.Caption, FileCaption}, {paths.HTML, FileHTML}} {
+			if f[0] == "" {
+				continue
+			}
+			mf, err := NewManifestFile(rootPath, f[0])
+			if err != nil {
+				return nil, err
+			}
+			mf.Role = f[1]
+			files = append(files, mf)
+		}
+	}
+	return files, nil
+}
+
+// NewManifestFile returns the size and checksum of the file at rel, relative
+// to rootPath.
+func NewManifestFile(rootPath, rel string) (ManifestFile, error) {
+	path := filepath.Join(rootPath, rel)
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	sum, err := FileSHA256(path)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{Path: filepath.ToSlash(rel), Size: finfo.Size(), SHA256: sum}, nil
+}
+
+// TweetStatus returns the status of a tweet captioning returned err for, and
+// the reason of statuses other than TweetCaptioned. Tweets of protected or
+// opted out accounts and deleted tweets are skipped.
+func TweetStatus(err error) (status, reason string) {
+	switch {
+	case err == nil:
+		return TweetCaptioned, ""
+	case errors.Is(err, ErrProtectedAccount), errors.Is(err, ErrOptedOut), errors.Is(err, ErrTweetUnavailable):
+		return TweetSkipped, err.Error()
+	}
+	return TweetFailed, err.Error()
+}
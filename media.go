@@ -0,0 +1,193 @@
+package twcapbot
+
+import (
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MaxImageBytes     = 5 * 1000 * 1000 // Upload limit of Twitter for images
+	MaxImageDimension = 8192            // Upload limit of Twitter for width and height of images
+
+	reencodeQuality  = 85
+	reencodeAttempts = 6
+	reencodeShrink   = 0.8 // Scale applied when a re-encoded image is still too large
+)
+
+// SplitImageForUpload cuts an image taller than MaxImageDimension into parts
+// of equal height that fit the limit, so that long captions stay readable
+// instead of being scaled down to a narrow strip. Parts are written next to
+// the image as PNG files suffixed with _part<i>.png and may be deleted once
+// they are uploaded. Images that are not too tall are returned as they are.
+func SplitImageForUpload(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if conf.Height <= MaxImageDimension {
+		return []string{path}, nil
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	p, perr := ReadProvenance(path)
+
+	b := src.Bounds()
+	count := (b.Dy() + MaxImageDimension - 1) / MaxImageDimension
+	height := (b.Dy() + count - 1) / count
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	paths := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		part := image.Rect(b.Min.X, b.Min.Y+i*height, b.Max.X, b.Min.Y+minInt((i+1)*height, b.Dy()))
+		dst := image.NewRGBA(image.Rect(0, 0, part.Dx(), part.Dy()))
+		draw.Draw(dst, dst.Bounds(), src, part.Min, draw.Src)
+
+		partPath := fmt.Sprintf("%v_part%v.png", base, i+1)
+		err = writePNG(dst, partPath)
+		if err == nil && perr == nil {
+			err = EmbedProvenance(partPath, p)
+		}
+		if err != nil {
+			for _, pp := range append(paths, partPath) {
+				os.Remove(pp)
+			}
+			return nil, err
+		}
+		paths = append(paths, partPath)
+	}
+	return paths, nil
+}
+
+// PrepareImageForUpload returns the path of a version of the image that
+// fits Twitter's upload limits. That is the image itself if it already fits,
+// otherwise a downscaled JPEG copy written next to it. Copies are suffixed
+// with _upload.jpg and may be deleted once they are uploaded.
+func PrepareImageForUpload(path string) (string, error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	conf, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if finfo.Size() <= MaxImageBytes && conf.Width <= MaxImageDimension && conf.Height <= MaxImageDimension {
+		return path, nil
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	scale := 1.0
+	if longest := maxInt(conf.Width, conf.Height); longest > MaxImageDimension {
+		scale = float64(MaxImageDimension) / float64(longest)
+	}
+
+	destPath := strings.TrimSuffix(path, filepath.Ext(path)) + "_upload.jpg"
+	for i := 0; i < reencodeAttempts; i++ {
+		err = writeScaledJPEG(src, scale, destPath)
+		if err != nil {
+			return "", err
+		}
+		finfo, err = os.Stat(destPath)
+		if err != nil {
+			return "", err
+		}
+		if finfo.Size() <= MaxImageBytes {
+			if p, err := ReadProvenance(path); err == nil {
+				err = EmbedProvenance(destPath, p)
+				if err != nil {
+					return "", err
+				}
+			}
+			return destPath, nil
+		}
+		scale *= reencodeShrink
+	}
+	os.Remove(destPath)
+	return "", fmt.Errorf("%v cannot be shrunk below %v bytes", path, MaxImageBytes)
+}
+
+// ScaleImage resizes img by the given factor, keeping at least one pixel in
+// each dimension.
+func ScaleImage(img image.Image, scale float64) image.Image {
+	b := img.Bounds()
+	w := maxInt(1, int(float64(b.Dx())*scale))
+	h := maxInt(1, int(float64(b.Dy())*scale))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+func writeScaledJPEG(img image.Image, scale float64, path string) error {
+	if scale != 1 {
+		img = ScaleImage(img, scale)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(f, img, &jpeg.Options{Quality: reencodeQuality})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writePNG(img image.Image, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, img)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
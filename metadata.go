@@ -0,0 +1,179 @@
+package twcapbot
+
+import (
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMetadataTimeLayout = "2006-01-02 15:04:05 MST"
+
+	tweetMetricsURL = "https://api.twitter.com/2/tweets/%v"
+)
+
+// MetadataOptions selects the fields of the metadata section of captions.
+// The section is left out if no field is selected.
+type MetadataOptions struct {
+	CreatedAt  bool // Creation time of the tweet
+	Engagement bool // Like, retweet, reply and quote counts at capture time
+	CapturedAt bool // Time the caption is generated
+	ReplyTo    bool // Tweet the captioned tweet replies to
+	Place      bool // Place the tweet is tagged with
+	Client     bool // App the tweet is published with
+
+	Location   *time.Location // Time zone of the times, nil means UTC
+	TimeLayout string         // Defaults to DefaultMetadataTimeLayout
+}
+
+// Names of metadata fields accepted by ParseMetadataFields.
+var metadataFields = []string{"created", "engagement", "captured", "replyto", "place", "client"}
+
+// ParseMetadataFields parses a comma separated list of metadata field names,
+// "all" selects every field.
+func ParseMetadataFields(s string) (MetadataOptions, error) {
+	opts := MetadataOptions{}
+	for _, name := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "":
+		case "all":
+			opts.CreatedAt, opts.Engagement, opts.CapturedAt = true, true, true
+			opts.ReplyTo, opts.Place, opts.Client = true, true, true
+		case "created":
+			opts.CreatedAt = true
+		case "engagement":
+			opts.Engagement = true
+		case "captured":
+			opts.CapturedAt = true
+		case "replyto":
+			opts.ReplyTo = true
+		case "place":
+			opts.Place = true
+		case "client":
+			opts.Client = true
+		default:
+			return opts, fmt.Errorf("unknown metadata field %q, valid values: all, %v", name, strings.Join(metadataFields, ", "))
+		}
+	}
+	return opts, nil
+}
+
+func (o MetadataOptions) Enabled() bool {
+	return o.CreatedAt || o.Engagement || o.CapturedAt || o.ReplyTo || o.Place || o.Client
+}
+
+// PublicMetrics are the engagement counts of a tweet.
+type PublicMetrics struct {
+	Likes    int `json:"like_count"`
+	Retweets int `json:"retweet_count"`
+	Replies  int `json:"reply_count"`
+	Quotes   int `json:"quote_count"`
+}
+
+// TweetMetadata is the content of the metadata section of captions.
+type TweetMetadata struct {
+	CreatedAt   time.Time
+	CapturedAt  time.Time
+	Metrics     PublicMetrics
+	FullMetrics bool // Replies and Quotes are known, API v1.1 doesn't report them
+
+	InReplyToScreenName string
+	InReplyToURL        string
+	Place               string
+	Client              string
+}
+
+// GetMetadataForTweet returns the metadata available in the tweet itself.
+// Reply and quote counts need API v2, see FetchPublicMetrics.
+func GetMetadataForTweet(tw twigger.Tweet) TweetMetadata {
+	meta := TweetMetadata{
+		CapturedAt: time.Now(),
+		Metrics:    PublicMetrics{Likes: tw.FavoriteCount, Retweets: tw.RetweetCount},
+		Client:     html.UnescapeString(tagRegex.ReplaceAllString(tw.Source, "")),
+	}
+	meta.CreatedAt, _ = time.Parse(time.RubyDate, tw.CreatedAt)
+	if tw.InReplyToStatusID != 0 {
+		meta.InReplyToScreenName = tw.InReplyToScreenName
+		meta.InReplyToURL = TweetURL(tw.InReplyToScreenName, tw.InReplyToStatusID)
+	}
+	if tw.Place.FullName != "" {
+		meta.Place = tw.Place.FullName
+		if tw.Place.Country != "" && !strings.Contains(tw.Place.FullName, tw.Place.Country) {
+			meta.Place += ", " + tw.Place.Country
+		}
+	}
+	return meta
+}
+
+// FetchPublicMetrics retrieves the engagement counts of a tweet from API v2.
+func (b *TweetCaptionBot) FetchPublicMetrics(id int64) (PublicMetrics, error) {
+	resp := struct {
+		Data struct {
+			PublicMetrics PublicMetrics `json:"public_metrics"`
+		} `json:"data"`
+	}{}
+	query := url.Values{"tweet.fields": {"public_metrics"}}
+	err := b.signedJSONRequest("GET", fmt.Sprintf(tweetMetricsURL, id), query, nil, &resp)
+	return resp.Data.PublicMetrics, err
+}
+
+// TweetMetadata returns the metadata of the tweet selected by the caption
+// options of the bot. If engagement counts are selected, they are retrieved
+// from API v2 with a fallback to the counts API v1.1 reports. Offline bots
+// use the counts of the saved tweet.
+func (b *TweetCaptionBot) TweetMetadata(tw twigger.Tweet) TweetMetadata {
+	meta := GetMetadataForTweet(tw)
+	if b.Captions.Metadata.Engagement && b.TwiggerConn != nil {
+		metrics, err := b.FetchPublicMetrics(tw.Id)
+		if err == nil {
+			meta.Metrics, meta.FullMetrics = metrics, true
+		} else {
+			b.ErrLog.Printf("Engagement counts of tweet (ID: %v) couldn't be retrieved from API v2. Error message: %v", tw.Id, err)
+		}
+	}
+	return meta
+}
+
+// MetadataCaption returns the metadata section of captions. ok is false if
+// none of the selected fields has a value.
+func MetadataCaption(meta TweetMetadata, opts MetadataOptions) (c Caption, ok bool) {
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	layout := opts.TimeLayout
+	if layout == "" {
+		layout = DefaultMetadataTimeLayout
+	}
+
+	lines := []string{}
+	if opts.CreatedAt && !meta.CreatedAt.IsZero() {
+		lines = append(lines, "Posted: "+meta.CreatedAt.In(loc).Format(layout))
+	}
+	if opts.Engagement {
+		counts := fmt.Sprintf("Likes: %v · Retweets: %v", meta.Metrics.Likes, meta.Metrics.Retweets)
+		if meta.FullMetrics {
+			counts += fmt.Sprintf(" · Replies: %v · Quotes: %v", meta.Metrics.Replies, meta.Metrics.Quotes)
+		}
+		lines = append(lines, counts+" (at capture time)")
+	}
+	if opts.CapturedAt && !meta.CapturedAt.IsZero() {
+		lines = append(lines, "Captured: "+meta.CapturedAt.In(loc).Format(layout))
+	}
+	if opts.ReplyTo && meta.InReplyToURL != "" {
+		lines = append(lines, fmt.Sprintf("In reply to @%v: %v", meta.InReplyToScreenName, meta.InReplyToURL))
+	}
+	if opts.Place && meta.Place != "" {
+		lines = append(lines, "Location: "+meta.Place)
+	}
+	if opts.Client && meta.Client != "" {
+		lines = append(lines, "Client: "+meta.Client)
+	}
+	if len(lines) == 0 {
+		return c, false
+	}
+	return NewNoteCaption(EscapeCaptionText(strings.Join(lines, "\n"))), true
+}
@@ -37,16 +37,19 @@ func GenerateFileNamesForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet) []T
 		} else if parent0.MediaTweet == true && child0.MediaTweet == false {
 			return parentFileNames
 		} else if parent0.MediaTweet == false && child0.MediaTweet == true {
+			// Media keeps the names of the quoted tweet, captions and the
+			// HTML file are named after the quoting tweet.
+			userName := fmt.Sprintf("%v_%v", tw.User.Id, tw.User.ScreenName)
 			ret := make([]TweetFileNameInfo, len(childFileNames))
 			for i, v := range childFileNames {
 				ret[i] = TweetFileNameInfo{
 					LongFileName:         v.LongFileName,
 					ShortFileName:        v.ShortFileName,
-					LongHTMLFileName:     v.LongHTMLFileName,
-					ShortHTMLFileName:    v.ShortHTMLFileName,
+					LongHTMLFileName:     parent0.LongHTMLFileName,
+					ShortHTMLFileName:    parent0.ShortHTMLFileName,
 					ShortDirName:         parent0.ShortDirName,
-					LongCaptionFileName:  v.LongFileName,
-					ShortCaptionFileName: v.ShortCaptionFileName,
+					LongCaptionFileName:  fmt.Sprintf("%v_%v_%v_caption.png", userName, tw.Id, v.MediaName),
+					ShortCaptionFileName: fmt.Sprintf("%v_%v_caption.png", tw.Id, v.MediaName),
 					ShortCaptionDirName:  parent0.ShortCaptionDirName,
 					MediaTweet:           true,
 					MediaURL:             v.MediaURL,
@@ -94,7 +97,7 @@ func GenerateFileNamesForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet) []T
 	for i, mediaName := range mediaNames {
 		info := TweetFileNameInfo{
 			LongFileName:         fmt.Sprintf("%v_%v_%v.png", userName, tw.Id, mediaName),
-			ShortFileName:        fmt.Sprintf("%v_%v", tw.Id, mediaName),
+			ShortFileName:        fmt.Sprintf("%v_%v.png", tw.Id, mediaName),
 			LongHTMLFileName:     fmt.Sprintf("%v_%v.html", userName, tw.Id),
 			ShortHTMLFileName:    fmt.Sprintf("%v.html", tw.Id),
 			ShortDirName:         userName,
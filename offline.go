@@ -0,0 +1,109 @@
+package twcapbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewOffline returns a bot without a Twitter connection. It captions tweets
+// saved earlier, see RecaptionTweet, and needs no network access as long as
+// its LocalMedia holds the media of the tweets and its renderer works
+// offline. Tweet cards are drawn with initials instead of avatars.
+func NewOffline(logFile *os.File, codes []string, outDirPath string) *TweetCaptionBot {
+	bot := newBot(codes, outDirPath, io.MultiWriter(logFile, os.Stdout), io.MultiWriter(logFile, os.Stderr))
+	bot.Card.NoAvatars = true
+	return bot
+}
+
+// LoadSavedTweets loads tweets saved with twigger's Tweets.Save. Unlike
+// Tweets.Load, it reports files that cannot be decoded.
+func LoadSavedTweets(path string) (twigger.Tweets, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tweets := twigger.Tweets{}
+	err = json.Unmarshal(data, &tweets)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return tweets, nil
+}
+
+// RecaptionTweet captions a saved tweet. The quoted tweet is taken from the
+// saved tweet as well, so no tweet is retrieved from Twitter.
+func (b *TweetCaptionBot) RecaptionTweet(tw twigger.Tweet, rootPath string) error {
+	var quotedTweet *twigger.Tweet = nil
+	if tw.QuotedStatus != nil {
+		qt := twigger.Tweet(*tw.QuotedStatus)
+		err := b.CheckTweet(qt)
+		if err == nil {
+			quotedTweet = &qt
+		} else {
+			b.InfoLog.Printf("Quoted tweet (ID: %v) of tweet (ID: %v) is left out: %v", qt.Id, tw.Id, err)
+		}
+	}
+	return b.CaptionFetchedTweet(tw, quotedTweet, rootPath)
+}
+
+// MediaIndex locates tweet media saved by earlier runs so that tweets can be
+// captioned again without downloading their media.
+type MediaIndex struct {
+	paths map[string]string // File name to path
+}
+
+// NewMediaIndex indexes the files under dirPath by their names. Media files
+// are named after the author, tweet and media IDs, so the names identify
+// them wherever they are placed under dirPath.
+func NewMediaIndex(dirPath string) (*MediaIndex, error) {
+	m := &MediaIndex{paths: map[string]string{}}
+	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if _, ok := m.paths[name]; !ok && !info.IsDir() {
+			m.paths[name] = path
+		}
+		return nil
+	})
+	return m, err
+}
+
+// Len returns the number of indexed files.
+func (m *MediaIndex) Len() int {
+	return len(m.paths)
+}
+
+// CopyTo copies the first indexed media file with one of the given names to
+// destPath. Earlier runs may have used other layouts, so a file can be known
+// by several names.
+func (m *MediaIndex) CopyTo(destPath string, names ...string) error {
+	srcPath := ""
+	for _, name := range names {
+		if path, ok := m.paths[name]; ok {
+			srcPath = path
+			break
+		}
+	}
+	if srcPath == "" {
+		return fmt.Errorf("%v: %w", names[0], ErrMediaNotFound)
+	}
+	if abs, err := filepath.Abs(srcPath); err == nil {
+		if dest, err := filepath.Abs(destPath); err == nil && abs == dest {
+			return nil
+		}
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFileAtomic(destPath, src)
+}
@@ -0,0 +1,112 @@
+package twcapbot
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// OptOutList is the file backed set of users who asked not to be captioned.
+// Each line of the file holds the user ID followed by the screen name at the
+// time of opting out.
+type OptOutList struct {
+	Path string
+
+	mu    sync.Mutex
+	users map[string]string
+}
+
+// LoadOptOutList loads the list at path. A missing file is an empty list and
+// is created on the first addition.
+func LoadOptOutList(path string) (*OptOutList, error) {
+	l := &OptOutList{Path: path, users: map[string]string{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		screenName := ""
+		if len(fields) > 1 {
+			screenName = fields[1]
+		}
+		l.users[fields[0]] = screenName
+	}
+	return l, scanner.Err()
+}
+
+func (l *OptOutList) Contains(userID string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.users[userID]
+	return ok
+}
+
+// Add records the user in the list and its file. Adding a user who is
+// already in the list is a no-op.
+func (l *OptOutList) Add(userID, screenName string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.users[userID]; ok {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%v %v\n", userID, screenName)
+	if err != nil {
+		return err
+	}
+	l.users[userID] = screenName
+	return nil
+}
+
+// PurgeUserFiles deletes every file and directory under the output directory
+// that is generated from tweets of the given user and returns their paths.
+func (b *TweetCaptionBot) PurgeUserFiles(userID int64) ([]string, error) {
+	prefix := fmt.Sprintf("%v_", userID)
+	matches := []string{}
+	err := filepath.Walk(b.OutDirPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == b.OutDirPath || !strings.HasPrefix(info.Name(), prefix) {
+			return nil
+		}
+		matches = append(matches, path)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range matches {
+		err := os.RemoveAll(path)
+		if err != nil {
+			return matches, err
+		}
+		b.InfoLog.Printf("%v is deleted because user %v has opted out", path, userID)
+	}
+	return matches, nil
+}
@@ -0,0 +1,379 @@
+package twcapbot
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A4 in points
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 36.0
+	pdfFooter     = 28.0 // Room for the line under images
+
+	pdfPagesObj = 2
+	pdfFontObj  = 3
+	pdfBoldObj  = 4
+	pdfFirstObj = 5
+
+	pdfDateLayout = "2006-01-02"
+)
+
+// PDFOptions configure the PDF document of a run.
+type PDFOptions struct {
+	Title    string
+	Account  string         // Account whose tweets are captioned, shown on the cover
+	Kind     string         // Kind of the tweets, e.g. tweets or favorites
+	Captured time.Time      // Time the tweets were retrieved, defaults to now
+	Location *time.Location // Time zone of shown times, nil means UTC
+	Layout   Layout         // Layout of the run, PerUserLayout if nil
+	Quality  int            // JPEG quality of images, defaults to 85
+}
+
+// PDF is a document of the tweets captioned under a root directory: a cover
+// page listing the account, kind of tweets, date range and capture time,
+// then a page per caption image, oldest tweet first. Tweet cards are the
+// caption images of tweets without media. Images are written as tweets are
+// added, only the page order is kept in memory, so caption images may be
+// removed once their tweet is added. It is safe for concurrent use.
+type PDF struct {
+	rootPath string
+	opts     PDFOptions
+
+	mu      sync.Mutex
+	w       *countingWriter
+	offsets []int64 // Offsets of objects, index 0 is object 1
+	pages   []pdfPage
+	seen    map[int64]bool
+	first   time.Time
+	last    time.Time
+	tweets  int
+}
+
+type pdfPage struct {
+	obj     int
+	created time.Time
+	id      int64
+	index   int // Index of the caption image of the tweet
+}
+
+// NewPDF starts a PDF document of the tweets under rootPath written to w.
+func NewPDF(w io.Writer, rootPath string, opts PDFOptions) (*PDF, error) {
+	if opts.Captured.IsZero() {
+		opts.Captured = time.Now()
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.Layout == nil {
+		opts.Layout = PerUserLayout{}
+	}
+	if opts.Quality <= 0 {
+		opts.Quality = reencodeQuality
+	}
+
+	p := &PDF{rootPath: rootPath, opts: opts, w: &countingWriter{w: w}, seen: map[int64]bool{}}
+	p.offsets = make([]int64, pdfFirstObj-1)
+	fmt.Fprint(p.w, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	p.writeObj(pdfFontObj, []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>"))
+	p.writeObj(pdfBoldObj, []byte("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>"))
+	return p, p.w.err
+}
+
+// Add adds the caption images of a captioned tweet to the document. Tweets
+// without caption images under the root directory are left out, ok is false
+// for them.
+func (p *PDF) Add(tw twigger.Tweet) (ok bool, err error) {
+	p.mu.Lock()
+	if p.seen[tw.Id] {
+		p.mu.Unlock()
+		return true, nil
+	}
+	p.seen[tw.Id] = true
+	p.mu.Unlock()
+
+	files := TweetFiles(p.rootPath, tw, p.opts.Layout)
+	if len(files) == 0 {
+		return false, nil
+	}
+	images := make([][]byte, len(files))
+	bounds := make([]image.Rectangle, len(files))
+	for i, f := range files {
+		images[i], bounds[i], err = pdfJPEG(filepath.Join(p.rootPath, f.Caption), p.opts.Quality)
+		if err != nil {
+			return false, fmt.Errorf("caption image of tweet %v: %w", tw.Id, err)
+		}
+	}
+
+	created, _ := time.Parse(time.RubyDate, tw.CreatedAt)
+	footer := "@" + tw.User.ScreenName
+	if !created.IsZero() {
+		footer += " · " + created.In(p.opts.Location).Format(DefaultMetadataTimeLayout)
+	}
+	footer += " · " + GetTweetURL(tw)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range images {
+		imgObj := p.writeObj(0, pdfImageObject(images[i], bounds[i]))
+		content := pdfImagePage(imgObj, bounds[i], footer)
+		contentObj := p.writeObj(0, pdfStream("", content))
+		pageObj := p.writeObj(0, []byte(fmt.Sprintf(
+			"<< /Type /Page /Parent %v 0 R /MediaBox [0 0 %v %v] /Resources << /Font << /F1 %v 0 R >> /XObject << /Im1 %v 0 R >> >> /Contents %v 0 R >>",
+			pdfPagesObj, pdfPageWidth, pdfPageHeight, pdfFontObj, imgObj, contentObj)))
+		p.pages = append(p.pages, pdfPage{obj: pageObj, created: created, id: tw.Id, index: i})
+	}
+	if !created.IsZero() {
+		if p.first.IsZero() || created.Before(p.first) {
+			p.first = created
+		}
+		if created.After(p.last) {
+			p.last = created
+		}
+	}
+	p.tweets++
+	return true, p.w.err
+}
+
+// Close writes the cover page and the page order and finishes the document.
+// It returns the number of tweets in the document and doesn't close the
+// underlying writer.
+func (p *PDF) Close() (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sort.SliceStable(p.pages, func(i, j int) bool {
+		a, b := p.pages[i], p.pages[j]
+		if a.created.Equal(b.created) {
+			if a.id == b.id {
+				return a.index < b.index
+			}
+			return a.id < b.id
+		}
+		// Tweets without creation times go last
+		if a.created.IsZero() || b.created.IsZero() {
+			return b.created.IsZero()
+		}
+		return a.created.Before(b.created)
+	})
+
+	coverObj := p.writeObj(0, pdfStream("", p.coverContent()))
+	cover := p.writeObj(0, []byte(fmt.Sprintf(
+		"<< /Type /Page /Parent %v 0 R /MediaBox [0 0 %v %v] /Resources << /Font << /F1 %v 0 R /F2 %v 0 R >> >> /Contents %v 0 R >>",
+		pdfPagesObj, pdfPageWidth, pdfPageHeight, pdfFontObj, pdfBoldObj, coverObj)))
+
+	kids := []string{fmt.Sprintf("%v 0 R", cover)}
+	for _, page := range p.pages {
+		kids = append(kids, fmt.Sprintf("%v 0 R", page.obj))
+	}
+	p.writeObj(pdfPagesObj, []byte(fmt.Sprintf("<< /Type /Pages /Kids [%v] /Count %v >>", strings.Join(kids, " "), len(kids))))
+
+	info := fmt.Sprintf("<< /Producer (%v) /CreationDate (D:%v) ", pdfString("twcapbot "+Version), time.Now().UTC().Format("20060102150405Z"))
+	if p.opts.Title != "" {
+		info += fmt.Sprintf("/Title (%v) ", pdfString(p.opts.Title))
+	}
+	infoObj := p.writeObj(0, []byte(info+">>"))
+	p.writeObj(1, []byte(fmt.Sprintf("<< /Type /Catalog /Pages %v 0 R >>", pdfPagesObj)))
+
+	xref := p.w.n
+	fmt.Fprintf(p.w, "xref\n0 %v\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		fmt.Fprintf(p.w, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(p.w, "trailer\n<< /Size %v /Root 1 0 R /Info %v 0 R >>\nstartxref\n%v\n%%%%EOF\n", len(p.offsets)+1, infoObj, xref)
+	return p.tweets, p.w.err
+}
+
+// WritePDF writes the PDF document of the tweets captioned under rootPath to
+// path, see PDF. It returns the number of tweets in the document.
+func WritePDF(path, rootPath string, tweets twigger.Tweets, opts PDFOptions) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	p, err := NewPDF(f, rootPath, opts)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	for _, tw := range tweets {
+		_, err := p.Add(tw)
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+	}
+	n, err := p.Close()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	return n, f.Close()
+}
+
+// coverContent returns the content stream of the cover page.
+func (p *PDF) coverContent() []byte {
+	title := p.opts.Title
+	if title == "" {
+		title = "Captioned tweets"
+	}
+	dates := "-"
+	if !p.first.IsZero() {
+		first, last := p.first.In(p.opts.Location).Format(pdfDateLayout), p.last.In(p.opts.Location).Format(pdfDateLayout)
+		dates = first
+		if last != first {
+			dates += " – " + last
+		}
+	}
+	rows := [][2]string{
+		{"Account", p.opts.Account},
+		{"Tweet type", p.opts.Kind},
+		{"Date range", dates},
+		{"Captured", p.opts.Captured.In(p.opts.Location).Format(DefaultMetadataTimeLayout)},
+		{"Tweets", fmt.Sprintf("%v on %v pages", p.tweets, len(p.pages))},
+	}
+
+	buf := &bytes.Buffer{}
+	y := pdfPageHeight - 2*pdfMargin - 24
+	fmt.Fprintf(buf, "BT /F2 24 Tf %v %v Td (%v) Tj ET\n", pdfMargin, y, pdfString(title))
+	y -= 48
+	for _, row := range rows {
+		if row[1] == "" {
+			continue
+		}
+		fmt.Fprintf(buf, "BT /F2 12 Tf %v %v Td (%v) Tj ET\n", pdfMargin, y, pdfString(row[0]))
+		fmt.Fprintf(buf, "BT /F1 12 Tf %v %v Td (%v) Tj ET\n", pdfMargin+96, y, pdfString(row[1]))
+		y -= 20
+	}
+	return buf.Bytes()
+}
+
+// writeObj writes object obj, or the next object if obj is 0, and returns
+// its number.
+func (p *PDF) writeObj(obj int, body []byte) int {
+	if obj == 0 {
+		p.offsets = append(p.offsets, 0)
+		obj = len(p.offsets)
+	}
+	p.offsets[obj-1] = p.w.n
+	fmt.Fprintf(p.w, "%v 0 obj\n", obj)
+	p.w.Write(body)
+	fmt.Fprint(p.w, "\nendobj\n")
+	return obj
+}
+
+// pdfJPEG encodes the image at path as a JPEG image on white.
+func pdfJPEG(path string, quality int) ([]byte, image.Rectangle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+
+	buf := &bytes.Buffer{}
+	err = jpeg.Encode(buf, flat, &jpeg.Options{Quality: quality})
+	return buf.Bytes(), flat.Bounds(), err
+}
+
+func pdfImageObject(data []byte, b image.Rectangle) []byte {
+	dict := fmt.Sprintf("/Type /XObject /Subtype /Image /Width %v /Height %v /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode",
+		b.Dx(), b.Dy())
+	return pdfStream(dict, data)
+}
+
+// pdfImagePage returns the content stream of a page showing the image, fit
+// into the page, above the footer line.
+func pdfImagePage(imgObj int, b image.Rectangle, footer string) []byte {
+	maxW := pdfPageWidth - 2*pdfMargin
+	maxH := pdfPageHeight - 2*pdfMargin - pdfFooter
+	w, h := float64(b.Dx()), float64(b.Dy())
+	scale := maxW / w
+	if h*scale > maxH {
+		scale = maxH / h
+	}
+	w, h = w*scale, h*scale
+	x := (pdfPageWidth - w) / 2
+	y := pdfPageHeight - pdfMargin - h
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "q %.2f 0 0 %.2f %.2f %.2f cm /Im1 Do Q\n", w, h, x, y)
+	fmt.Fprintf(buf, "BT /F1 9 Tf 0.33 0.39 0.44 rg %.2f %.2f Td (%v) Tj ET\n", x, y-pdfFooter/2-4, pdfString(footer))
+	return buf.Bytes()
+}
+
+func pdfStream(dict string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "<< %v /Length %v >>\nstream\n", dict, len(data))
+	buf.Write(data)
+	buf.WriteString("\nendstream")
+	return buf.Bytes()
+}
+
+// winAnsi maps characters outside Latin-1 to WinAnsiEncoding, the encoding
+// of the standard fonts.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89,
+	'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95,
+	'–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// pdfString encodes s as the content of a PDF string in WinAnsiEncoding.
+// Characters the encoding lacks become question marks.
+func pdfString(s string) string {
+	buf := &strings.Builder{}
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			buf.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(buf, "\\%03o", r)
+		case winAnsi[r] != 0:
+			fmt.Fprintf(buf, "\\%03o", winAnsi[r])
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	return buf.String()
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,404 @@
+package twcapbot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/gusanmaz/twigger"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Version is the version of twcapbot recorded in generated images.
+const Version = "0.2.0"
+
+// Provenance records where a generated image comes from.
+type Provenance struct {
+	TweetID     string
+	Author      string // Screen name of the author
+	URL         string
+	CapturedAt  time.Time
+	Software    string // twcapbot and its version
+	MediaFile   string // Original media file relative to the image, slash separated, empty for text-only tweets
+	MediaSHA256 string // Hex encoded hash of the original media file
+}
+
+// Keywords of PNG text chunks. Author is stored in an iTXt chunk as screen
+// names are not limited to Latin-1, the others in tEXt chunks.
+const (
+	pngKeyTweetID     = "Tweet ID"
+	pngKeyAuthor      = "Author"
+	pngKeyURL         = "URL"
+	pngKeyCapturedAt  = "Creation Time"
+	pngKeySoftware    = "Software"
+	pngKeyMediaFile   = "Media File"
+	pngKeyMediaSHA256 = "Media SHA-256"
+
+	xmpNamespace = "https://github.com/gusanmaz/twcapbot/ns/1.0/"
+	xmpHeader    = "http://ns.adobe.com/xap/1.0/\x00"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	ErrNoProvenance = errors.New("image carries no provenance metadata")
+)
+
+// NewProvenance returns the provenance of an image generated from the tweet.
+// mediaPath is the original media file, empty for text-only tweets. MediaFile
+// is set to its base name, see RecordProvenance for media in other
+// directories.
+func NewProvenance(tweetID int64, author, tweetURL, mediaPath string) (Provenance, error) {
+	p := Provenance{
+		TweetID:    fmt.Sprint(tweetID),
+		Author:     author,
+		URL:        tweetURL,
+		CapturedAt: time.Now().UTC().Truncate(time.Second),
+		Software:   "twcapbot " + Version,
+	}
+	if mediaPath != "" {
+		sum, err := FileSHA256(mediaPath)
+		if err != nil {
+			return p, err
+		}
+		p.MediaFile, p.MediaSHA256 = filepath.Base(mediaPath), sum
+	}
+	return p, nil
+}
+
+// RecordProvenance embeds the provenance of a caption image generated from
+// the tweet. MediaFile is the path of the media relative to the image, as
+// layouts may put captions and media into different directories. Failures
+// are logged, the image is usable without provenance.
+func (b *TweetCaptionBot) RecordProvenance(tw twigger.Tweet, mediaPath, imagePath string) {
+	p, err := NewProvenance(tw.Id, tw.User.ScreenName, GetTweetURL(tw), mediaPath)
+	if err == nil && mediaPath != "" {
+		var rel string
+		rel, err = filepath.Rel(filepath.Dir(imagePath), mediaPath)
+		p.MediaFile = filepath.ToSlash(rel)
+	}
+	if err == nil {
+		err = EmbedProvenance(imagePath, p)
+	}
+	if err != nil {
+		b.ErrLog.Printf("Provenance couldn't be embedded into %v. Error message: %v", imagePath, err)
+	}
+}
+
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (p Provenance) fields() [][2]string {
+	return [][2]string{
+		{pngKeyTweetID, p.TweetID},
+		{pngKeyAuthor, p.Author},
+		{pngKeyURL, p.URL},
+		{pngKeyCapturedAt, p.CapturedAt.Format(time.RFC3339)},
+		{pngKeySoftware, p.Software},
+		{pngKeyMediaFile, p.MediaFile},
+		{pngKeyMediaSHA256, p.MediaSHA256},
+	}
+}
+
+func (p *Provenance) setField(key, value string) {
+	switch key {
+	case pngKeyTweetID:
+		p.TweetID = value
+	case pngKeyAuthor:
+		p.Author = value
+	case pngKeyURL:
+		p.URL = value
+	case pngKeyCapturedAt:
+		p.CapturedAt, _ = time.Parse(time.RFC3339, value)
+	case pngKeySoftware:
+		p.Software = value
+	case pngKeyMediaFile:
+		p.MediaFile = value
+	case pngKeyMediaSHA256:
+		p.MediaSHA256 = value
+	}
+}
+
+// EmbedProvenance writes p into the PNG or JPEG image at path, replacing
+// provenance written earlier.
+func EmbedProvenance(path string, p Provenance) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		data, err = embedPNG(data, p)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		data, err = embedJPEG(data, p)
+	default:
+		err = fmt.Errorf("%v is neither a PNG nor a JPEG image", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadProvenance reads the provenance written by EmbedProvenance.
+func ReadProvenance(path string) (Provenance, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Provenance{}, err
+	}
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNG(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return readJPEG(data)
+	}
+	return Provenance{}, fmt.Errorf("%v is neither a PNG nor a JPEG image", path)
+}
+
+// pngChunks calls fn for every chunk of a PNG image with the offsets of the
+// chunk and its data.
+func pngChunks(data []byte, fn func(typ string, start, end int, chunk []byte) bool) error {
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return errors.New("truncated PNG chunk")
+		}
+		if !fn(string(data[pos+4:pos+8]), pos, end, data[pos+8:pos+8+length]) {
+			return nil
+		}
+		pos = end
+	}
+	return nil
+}
+
+func pngChunk(typ string, content []byte) []byte {
+	chunk := make([]byte, 8, 12+len(content))
+	binary.BigEndian.PutUint32(chunk, uint32(len(content)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, content...)
+	crc := crc32.ChecksumIEEE(chunk[4:])
+	return append(chunk, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func isProvenanceKey(key string) bool {
+	for _, f := range (Provenance{}).fields() {
+		if f[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+func embedPNG(data []byte, p Provenance) ([]byte, error) {
+	out := append([]byte{}, pngSignature...)
+	err := pngChunks(data, func(typ string, start, end int, chunk []byte) bool {
+		if typ == "tEXt" || typ == "iTXt" {
+			key := string(bytes.SplitN(chunk, []byte{0}, 2)[0])
+			if isProvenanceKey(key) {
+				return true
+			}
+		}
+		if typ == "IEND" {
+			for _, f := range p.fields() {
+				if f[1] == "" {
+					continue
+				}
+				if f[0] == pngKeyAuthor {
+					// Keyword, null, no compression, method, empty language
+					// tag and translated keyword.
+					content := append([]byte(f[0]), 0, 0, 0, 0, 0)
+					out = append(out, pngChunk("iTXt", append(content, f[1]...))...)
+				} else {
+					content := append([]byte(f[0]), 0)
+					out = append(out, pngChunk("tEXt", append(content, f[1]...))...)
+				}
+			}
+		}
+		out = append(out, data[start:end]...)
+		return true
+	})
+	return out, err
+}
+
+func readPNG(data []byte) (Provenance, error) {
+	p := Provenance{}
+	found := false
+	err := pngChunks(data, func(typ string, start, end int, chunk []byte) bool {
+		parts := bytes.SplitN(chunk, []byte{0}, 2)
+		if len(parts) != 2 || !isProvenanceKey(string(parts[0])) {
+			return true
+		}
+		value := parts[1]
+		switch typ {
+		case "tEXt":
+		case "iTXt":
+			// Skip compression flag and method, language tag and translated
+			// keyword. Compressed values are never written by this package.
+			if len(value) < 2 || value[0] != 0 {
+				return true
+			}
+			rest := bytes.SplitN(value[2:], []byte{0}, 3)
+			if len(rest) != 3 {
+				return true
+			}
+			value = rest[2]
+		default:
+			return true
+		}
+		p.setField(string(parts[0]), string(value))
+		found = true
+		return true
+	})
+	if err == nil && !found {
+		err = ErrNoProvenance
+	}
+	return p, err
+}
+
+// xmpMeta is the XMP packet written into JPEG images.
+type xmpMeta struct {
+	XMLName xml.Name `xml:"x:xmpmeta"`
+	X       string   `xml:"xmlns:x,attr"`
+	RDF     struct {
+		RDF         string `xml:"xmlns:rdf,attr"`
+		Description struct {
+			About       string `xml:"rdf:about,attr"`
+			NS          string `xml:"xmlns:twcapbot,attr"`
+			TweetID     string `xml:"twcapbot:TweetID,attr"`
+			Author      string `xml:"twcapbot:Author,attr"`
+			URL         string `xml:"twcapbot:URL,attr"`
+			CapturedAt  string `xml:"twcapbot:CapturedAt,attr"`
+			Software    string `xml:"twcapbot:Software,attr"`
+			MediaFile   string `xml:"twcapbot:MediaFile,attr,omitempty"`
+			MediaSHA256 string `xml:"twcapbot:MediaSHA256,attr,omitempty"`
+		} `xml:"rdf:Description"`
+	} `xml:"rdf:RDF"`
+}
+
+// jpegSegments calls fn for every marker segment before the image data of a
+// JPEG image.
+func jpegSegments(data []byte, fn func(marker byte, start, end int, payload []byte)) error {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return errors.New("invalid JPEG marker")
+		}
+		marker := data[pos+1]
+		if marker == 0xda {
+			return nil
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end > len(data) {
+			return errors.New("truncated JPEG segment")
+		}
+		fn(marker, pos, end, data[pos+4:end])
+		pos = end
+	}
+	return nil
+}
+
+func isXMPSegment(marker byte, payload []byte) bool {
+	return marker == 0xe1 && bytes.HasPrefix(payload, []byte(xmpHeader)) && bytes.Contains(payload, []byte(xmpNamespace))
+}
+
+func embedJPEG(data []byte, p Provenance) ([]byte, error) {
+	meta := xmpMeta{X: "adobe:ns:meta/"}
+	meta.RDF.RDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	d := &meta.RDF.Description
+	d.NS = xmpNamespace
+	d.TweetID, d.Author, d.URL = p.TweetID, p.Author, p.URL
+	d.CapturedAt, d.Software = p.CapturedAt.Format(time.RFC3339), p.Software
+	d.MediaFile, d.MediaSHA256 = p.MediaFile, p.MediaSHA256
+	packet, err := xml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	payload := append([]byte(xmpHeader), packet...)
+	if len(payload)+2 > 0xffff {
+		return nil, errors.New("provenance is too large for a JPEG segment")
+	}
+	segment := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	// The segment goes after the JFIF or Exif segments that must come first.
+	out := append([]byte{}, data[:2]...)
+	last := 2
+	err = jpegSegments(data, func(marker byte, start, end int, payload []byte) {
+		if isXMPSegment(marker, payload) {
+			out = append(out, data[last:start]...)
+			last = end
+			return
+		}
+		if start == last && (marker == 0xe0 || (marker == 0xe1 && !bytes.HasPrefix(payload, []byte(xmpHeader)))) {
+			out = append(out, data[last:end]...)
+			last = end
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, segment...)
+	return append(out, data[last:]...), nil
+}
+
+func readJPEG(data []byte) (Provenance, error) {
+	p := Provenance{}
+	found := false
+	err := jpegSegments(data, func(marker byte, start, end int, payload []byte) {
+		if found || !isXMPSegment(marker, payload) {
+			return
+		}
+		var raw struct {
+			RDF struct {
+				Description struct {
+					TweetID     string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ TweetID,attr"`
+					Author      string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ Author,attr"`
+					URL         string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ URL,attr"`
+					CapturedAt  string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ CapturedAt,attr"`
+					Software    string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ Software,attr"`
+					MediaFile   string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ MediaFile,attr"`
+					MediaSHA256 string `xml:"https://github.com/gusanmaz/twcapbot/ns/1.0/ MediaSHA256,attr"`
+				} `xml:"Description"`
+			} `xml:"RDF"`
+		}
+		if xml.Unmarshal(payload[len(xmpHeader):], &raw) != nil {
+			return
+		}
+		d := raw.RDF.Description
+		p = Provenance{TweetID: d.TweetID, Author: d.Author, URL: d.URL, Software: d.Software, MediaFile: d.MediaFile, MediaSHA256: d.MediaSHA256}
+		p.CapturedAt, _ = time.Parse(time.RFC3339, d.CapturedAt)
+		found = true
+	})
+	if err == nil && !found {
+		err = ErrNoProvenance
+	}
+	return p, err
+}
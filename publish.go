@@ -0,0 +1,221 @@
+package twcapbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/garyburd/go-oauth/oauth"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaMetadataURL = "https://upload.twitter.com/1.1/media/metadata/create.json"
+
+	MaxMediaPerTweet = 4
+)
+
+// PublishTextReply publishes a text tweet as a reply to the tweet with the
+// given ID and returns the ID of the published tweet.
+func (b *TweetCaptionBot) PublishTextReply(text string, replyToID int64) (int64, error) {
+	v := url.Values{}
+	v.Set("in_reply_to_status_id", fmt.Sprintf("%v", replyToID))
+	tw, err := b.TwiggerConn.Client.PostTweet(text, v)
+	if err != nil {
+		b.ErrLog.Printf("Text reply to tweet (ID: %v) couldn't be published. Error message: %v", replyToID, err)
+		return -1, err
+	}
+	b.InfoLog.Printf("Text reply (ID: %v) to tweet (ID: %v) has been published", tw.Id, replyToID)
+	return tw.Id, nil
+}
+
+// PublishCaptionThread publishes the images as a reply to the tweet with the
+// given ID. Images taller than Twitter allows are cut into parts first, see
+// SplitImageForUpload. Images that don't fit into a single tweet are spread
+// over a thread of replies, each numbered as (i/n). altTexts is either nil or
+// has an entry for each image. IDs of the published tweets are returned in
+// order.
+func (b *TweetCaptionBot) PublishCaptionThread(paths, altTexts []string, text string, replyToID int64) ([]int64, error) {
+	paths, altTexts, parts, err := splitImages(paths, altTexts)
+	defer func() {
+		for _, p := range parts {
+			os.Remove(p)
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 0 {
+		b.InfoLog.Printf("Images taller than %v pixels are cut into %v parts", MaxImageDimension, len(parts))
+	}
+
+	count := (len(paths) + MaxMediaPerTweet - 1) / MaxMediaPerTweet
+	ids := make([]int64, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * MaxMediaPerTweet
+		end := start + MaxMediaPerTweet
+		if end > len(paths) {
+			end = len(paths)
+		}
+		var alts []string
+		if altTexts != nil {
+			alts = altTexts[start:end]
+		}
+
+		tweetText := text
+		if count > 1 {
+			tweetText = fmt.Sprintf("%v (%v/%v)", text, i+1, count)
+		}
+		id, err := b.PublishCaptionReply(paths[start:end], alts, tweetText, replyToID)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+		replyToID = id
+	}
+	return ids, nil
+}
+
+// splitImages cuts the tall images among paths into parts. Parts of an image
+// share its alt text, numbered as (i/n). Paths of the parts are returned as
+// well to be removed after upload.
+func splitImages(paths, altTexts []string) (split, splitAlts, parts []string, err error) {
+	for i, path := range paths {
+		imgParts, err := SplitImageForUpload(path)
+		if err != nil {
+			return nil, nil, parts, err
+		}
+		if len(imgParts) > 1 {
+			parts = append(parts, imgParts...)
+		}
+		split = append(split, imgParts...)
+		if altTexts == nil {
+			continue
+		}
+		for j := range imgParts {
+			alt := altTexts[i]
+			if len(imgParts) > 1 && alt != "" {
+				n := fmt.Sprintf(" (%v/%v)", j+1, len(imgParts))
+				alt = TruncateText(alt, MaxAltTextLength-len([]rune(n))) + n
+			}
+			splitAlts = append(splitAlts, alt)
+		}
+	}
+	return split, splitAlts, parts, nil
+}
+
+// PublishCaptionReply uploads the images, attaches alt texts to them and
+// publishes them as a reply to the tweet with the given ID. Images exceeding
+// upload limits are re-encoded first. altTexts is either nil or has an entry
+// for each image, empty entries are skipped.
+func (b *TweetCaptionBot) PublishCaptionReply(paths, altTexts []string, text string, replyToID int64) (int64, error) {
+	if len(paths) > MaxMediaPerTweet {
+		b.InfoLog.Printf("A tweet may not contain more than %v images, only first %v of %v are published",
+			MaxMediaPerTweet, MaxMediaPerTweet, len(paths))
+		paths = paths[:MaxMediaPerTweet]
+	}
+
+	mediaIDs := make([]string, len(paths))
+	for i, path := range paths {
+		uploadPath, err := PrepareImageForUpload(path)
+		if err != nil {
+			return -1, err
+		}
+		if uploadPath != path {
+			b.InfoLog.Printf("%v exceeds upload limits, it is re-encoded as %v", path, uploadPath)
+		}
+		mediaID, err := b.TwiggerConn.UploadImage(uploadPath)
+		if uploadPath != path {
+			os.Remove(uploadPath)
+		}
+		if err != nil {
+			return -1, err
+		}
+		mediaIDs[i] = strconv.FormatInt(mediaID, 10)
+
+		if i < len(altTexts) && altTexts[i] != "" {
+			err = b.SetAltText(mediaID, altTexts[i])
+			if err != nil {
+				// Image without alt text is still better than no reply.
+				b.ErrLog.Printf("Alt text of %v couldn't be set. Error message: %v", path, err)
+			}
+		}
+	}
+
+	v := url.Values{}
+	v.Set("media_ids", strings.Join(mediaIDs, ","))
+	if replyToID > 0 {
+		v.Set("in_reply_to_status_id", fmt.Sprintf("%v", replyToID))
+	}
+	tw, err := b.TwiggerConn.Client.PostTweet(text, v)
+	if err != nil {
+		b.ErrLog.Printf("Caption reply to tweet (ID: %v) couldn't be published. Error message: %v", replyToID, err)
+		return -1, err
+	}
+	b.InfoLog.Printf("Caption reply (ID: %v) to tweet (ID: %v) has been published", tw.Id, replyToID)
+	return tw.Id, nil
+}
+
+// SetAltText attaches alt text to an uploaded image through the media
+// metadata endpoint.
+func (b *TweetCaptionBot) SetAltText(mediaID int64, text string) error {
+	body := map[string]interface{}{
+		"media_id": strconv.FormatInt(mediaID, 10),
+		"alt_text": map[string]string{"text": TruncateText(text, MaxAltTextLength)},
+	}
+	return b.signedJSONRequest(http.MethodPost, mediaMetadataURL, nil, body, nil)
+}
+
+// signedJSONRequest issues an OAuth 1.0a signed request with the bot's
+// credentials for the endpoints anaconda doesn't cover. body, if not nil, is
+// sent as JSON and the response is decoded into out if out is not nil.
+func (b *TweetCaptionBot) signedJSONRequest(method, urlStr string, query url.Values, body, out interface{}) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		err = json.NewEncoder(&reqBody).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u.String(), &reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	creds := b.TwiggerConn.Credentials
+	client := oauth.Client{Credentials: oauth.Credentials{Token: creds.APIKey, Secret: creds.APISecret}}
+	token := oauth.Credentials{Token: creds.AccessToken, Secret: creds.AccessSecret}
+	// JSON bodies are not part of the OAuth signature, only the query is.
+	err = client.SetAuthorizationHeader(req.Header, &token, method, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return anaconda.NewApiError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,197 @@
+package twcapbot
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Renderer attaches captions to a tweet image.
+type Renderer interface {
+	// Render writes the image at srcPath together with captions to destPath
+	// as a PNG image.
+	Render(srcPath string, captions []Caption, destPath string) error
+}
+
+const (
+	RendererCapdec = "capdec" // Renders captions as HTML in a headless browser
+	RendererGo     = "go"     // Pure Go renderer, needs no browser
+)
+
+// NewRenderer returns the renderer with the given name. An empty name selects
+// capdec if the package is built with it, otherwise the pure Go renderer,
+// which is only available with the nocapdec tag. codes are passed to capdec.
+func NewRenderer(name string, codes []string) (Renderer, error) {
+	if name == "" {
+		name = RendererGo
+		if capdecAvailable {
+			name = RendererCapdec
+		}
+	}
+	switch name {
+	case RendererCapdec:
+		if !capdecAvailable {
+			return nil, errCapdecUnavailable
+		}
+		return &CapdecRenderer{JSCodes: codes}, nil
+	case RendererGo:
+		if capdecAvailable {
+			return nil, errGoRendererUnavailable
+		}
+		return NewImageRenderer(), nil
+	}
+	return nil, fmt.Errorf("unknown renderer %q, valid values: %v, %v", name, RendererCapdec, RendererGo)
+}
+
+// ImageRenderer is a pure Go Renderer that stacks the source image and the
+// caption blocks on top of each other.
+type ImageRenderer struct {
+	MinWidth int     // Narrower images are centered on a canvas this wide
+	Padding  int     // Around and between caption blocks
+	FontSize float64 // 0 scales the text with the width of the image
+
+	Background color.Color
+	Foreground color.Color
+	Separator  color.Color // Line drawn between caption blocks
+	Highlight  color.Color // Mentions and hashtags of styled captions
+
+	// Empty font path selects the Go font. Fallback fonts are used for
+	// glyphs the main font lacks, NewImageRenderer sets them to
+	// SystemFallbackFonts.
+	FontPath          string
+	FallbackFontPaths []string
+}
+
+func NewImageRenderer() *ImageRenderer {
+	return &ImageRenderer{
+		MinWidth:   800,
+		Padding:    24,
+		Background: color.White,
+		Foreground: color.RGBA{0x0f, 0x14, 0x19, 0xff},
+		Separator:  color.RGBA{0xcf, 0xd9, 0xde, 0xff},
+		Highlight:  color.RGBA{0x1d, 0x9b, 0xf0, 0xff},
+
+		FallbackFontPaths: SystemFallbackFonts(),
+	}
+}
+
+// captionLine is a line of caption text in logical order.
+type captionLine struct {
+	text   string
+	rtl    bool
+	marked []bool // Highlighted runes of text
+}
+
+func (r *ImageRenderer) Render(srcPath string, captions []Caption, destPath string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	src, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	sb := src.Bounds()
+	width := maxInt(sb.Dx(), r.MinWidth)
+	size := r.FontSize
+	if size == 0 {
+		size = float64(width) / 36
+		if size < 14 {
+			size = 14
+		} else if size > 64 {
+			size = 64
+		}
+	}
+	face, err := newTextFace(size, append([]string{r.FontPath}, r.FallbackFontPaths...)...)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	blocks := make([][]captionLine, 0, len(captions))
+	height := sb.Dy()
+	for _, caption := range captions {
+		lines := r.captionLines(face, caption, width-2*r.Padding)
+		blocks = append(blocks, lines)
+		height += r.Padding + len(lines)*face.lineHeight()
+	}
+	height += r.Padding
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(r.Background), image.Point{}, draw.Src)
+	x := (width - sb.Dx()) / 2
+	draw.Draw(img, image.Rect(x, 0, x+sb.Dx(), sb.Dy()), src, sb.Min, draw.Over)
+
+	y := sb.Dy()
+	for i, lines := range blocks {
+		if i > 0 {
+			sep := image.Rect(r.Padding, y, width-r.Padding, y+1)
+			draw.Draw(img, sep, image.NewUniform(r.Separator), image.Point{}, draw.Src)
+		}
+		y += r.Padding
+		for _, line := range lines {
+			text, marked := face.visualMarked(line.text, line.marked, line.rtl)
+			x := r.Padding
+			if line.rtl {
+				x = width - r.Padding - face.measure(text)
+			}
+			face.drawHighlighted(img, x, y+face.ascent(), text, r.Foreground, r.Highlight, marked)
+			y += face.lineHeight()
+		}
+	}
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(out, img)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// captionLines wraps the caption into lines. Right-to-left text goes below
+// its label and is aligned to the right.
+func (r *ImageRenderer) captionLines(face *textFace, c Caption, width int) []captionLine {
+	lines := []captionLine{}
+	add := func(text string, rtl bool, marked []bool) {
+		runes := []rune(text)
+		for _, span := range face.wrapRunes(runes, width) {
+			lines = append(lines, captionLine{string(runes[span[0]:span[1]]), rtl, marked[span[0]:span[1]]})
+		}
+	}
+	label, text := PlainCaption(c.Label), PlainCaption(c.Text)
+	marked := markRanges(text, c.Highlights)
+	switch {
+	case label == "":
+		add(text, c.Dir == DirRTL, marked)
+	case c.Dir == DirRTL:
+		add(label, false, markRanges(label, nil))
+		add(text, true, marked)
+	default:
+		add(label+" "+text, false, append(markRanges(label+" ", nil), marked...))
+	}
+	return lines
+}
+
+var (
+	lineBreakRegex = regexp.MustCompile(`\s*<br\s*/?>`)
+	tagRegex       = regexp.MustCompile(`<[^>]*>`)
+)
+
+// PlainCaption converts an HTML caption fragment into plain text.
+func PlainCaption(caption string) string {
+	s := lineBreakRegex.ReplaceAllString(caption, "\n")
+	s = tagRegex.ReplaceAllString(s, "")
+	return strings.TrimSpace(html.UnescapeString(s))
+}
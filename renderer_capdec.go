@@ -0,0 +1,36 @@
+//go:build !nocapdec
+// +build !nocapdec
+
+package twcapbot
+
+import (
+	"errors"
+	"github.com/gusanmaz/capdec"
+	"sync"
+)
+
+const capdecAvailable = true
+
+var errCapdecUnavailable error
+
+// capdec starts its browser as soon as the program starts, so the pure Go
+// renderer is only offered by builds without it.
+var errGoRendererUnavailable = errors.New("go renderer needs a build with -tags nocapdec, capdec of this build starts a browser regardless of the renderer")
+
+// capdec drives a single browser through package level state.
+var capdecMu sync.Mutex
+
+// CapdecRenderer renders captions as HTML in a headless browser with capdec.
+type CapdecRenderer struct {
+	JSCodes []string
+}
+
+func (r *CapdecRenderer) Render(srcPath string, captions []Caption, destPath string) error {
+	fragments := make([]string, len(captions))
+	for i, c := range captions {
+		fragments[i] = c.HTML()
+	}
+	capdecMu.Lock()
+	defer capdecMu.Unlock()
+	return capdec.Caption(srcPath, fragments, destPath, r.JSCodes)
+}
@@ -0,0 +1,22 @@
+//go:build nocapdec
+// +build nocapdec
+
+package twcapbot
+
+import "errors"
+
+const capdecAvailable = false
+
+var errCapdecUnavailable = errors.New("capdec renderer is not available, the program is built with the nocapdec tag")
+
+var errGoRendererUnavailable error
+
+// CapdecRenderer is a stub of the capdec renderer for builds without a
+// headless browser.
+type CapdecRenderer struct {
+	JSCodes []string
+}
+
+func (r *CapdecRenderer) Render(srcPath string, captions []Caption, destPath string) error {
+	return errCapdecUnavailable
+}
@@ -0,0 +1,49 @@
+package twcapbot
+
+import (
+	"github.com/gusanmaz/twigger"
+	"html"
+	"strings"
+)
+
+// TweetText returns the text of a tweet as plain text with t.co links
+// replaced by the abbreviated URLs Twitter displays. See ExpandTweetText.
+func TweetText(tw twigger.Tweet) string {
+	return ExpandTweetText(tw, false)
+}
+
+// ExpandTweetText returns the text of a tweet as plain text. Twitter escapes
+// &, < and > in tweet texts as HTML entities, these are unescaped. t.co links
+// are replaced by the URLs they point to, in full if fullURLs is set and
+// abbreviated as Twitter displays them otherwise. Links pointing at the
+// tweet's own media are removed as the media is captioned anyway.
+func ExpandTweetText(tw twigger.Tweet, fullURLs bool) string {
+	text := tw.FullText
+	if text == "" {
+		text = tw.Text
+	}
+	// Expanded URLs are raw, they may contain entity-like query strings.
+	text = html.UnescapeString(text)
+	for _, m := range append(tw.Entities.Media, tw.ExtendedEntities.Media...) {
+		if m.Url != "" {
+			text = strings.Replace(text, m.Url, "", -1)
+		}
+	}
+	for _, u := range tw.Entities.Urls {
+		expanded := u.Display_url
+		if fullURLs || expanded == "" {
+			expanded = u.Expanded_url
+		}
+		if u.Url != "" && expanded != "" {
+			text = strings.Replace(text, u.Url, expanded, -1)
+		}
+	}
+	return strings.TrimSpace(text)
+}
+
+// EscapeCaptionText makes plain text safe to embed into an HTML caption.
+// Line breaks of the text are kept as <br/> tags.
+func EscapeCaptionText(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	return strings.Replace(html.EscapeString(text), "\n", "<br/>", -1)
+}
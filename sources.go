@@ -0,0 +1,249 @@
+package twcapbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ChimeraCoder/anaconda"
+	"github.com/gusanmaz/twigger"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	lookupBatchSize  = 100 // Limit of statuses/lookup
+	searchPageSize   = 100
+	listPageSize     = 200
+	timelinePageSize = 200
+	bookmarkPage     = 100
+
+	usersMeURL   = "https://api.twitter.com/2/users/me"
+	bookmarksURL = "https://api.twitter.com/2/users/%v/bookmarks"
+)
+
+// extendedValues returns request parameters asking for full tweet texts.
+func extendedValues() url.Values {
+	return url.Values{"tweet_mode": {"extended"}}
+}
+
+// request runs an API request through Throttle if it is set.
+func (b *TweetCaptionBot) request(f func() error) error {
+	if b.Throttle == nil {
+		return f()
+	}
+	return b.Throttle(f)
+}
+
+// GetUserTweets retrieves recent tweets of the user, at most max of them
+// unless max is 0. Twitter serves the latest 3200 tweets of a user.
+func (b *TweetCaptionBot) GetUserTweets(screenName string, max int) (twigger.Tweets, error) {
+	return b.getTimeline(b.TwiggerConn.Client.GetUserTimeline, screenName, max)
+}
+
+// GetUserFavorites retrieves recent favorites of the user, at most max of
+// them unless max is 0.
+func (b *TweetCaptionBot) GetUserFavorites(screenName string, max int) (twigger.Tweets, error) {
+	return b.getTimeline(b.TwiggerConn.Client.GetFavorites, screenName, max)
+}
+
+// getTimeline pages through a timeline of the user from newest to oldest
+// tweet.
+func (b *TweetCaptionBot) getTimeline(get func(url.Values) ([]anaconda.Tweet, error), screenName string, max int) (twigger.Tweets, error) {
+	v := extendedValues()
+	v.Set("screen_name", screenName)
+	v.Set("count", strconv.Itoa(timelinePageSize))
+
+	tweets := twigger.Tweets{}
+	for {
+		var page []anaconda.Tweet
+		err := b.request(func() (err error) {
+			page, err = get(v)
+			return err
+		})
+		if err != nil {
+			return tweets, err
+		}
+		if len(page) == 0 {
+			return tweets, nil
+		}
+		for _, tw := range page {
+			tweets = append(tweets, twigger.Tweet(tw))
+		}
+		if max > 0 && len(tweets) >= max {
+			return tweets[:max], nil
+		}
+		b.InfoLog.Printf("%v tweets of @%v are retrieved", len(tweets), screenName)
+		v.Set("max_id", strconv.FormatInt(page[len(page)-1].Id-1, 10))
+	}
+}
+
+// LookupTweets retrieves the tweets with the given IDs in the given order.
+// Deleted tweets and tweets the bot cannot see are left out.
+func (b *TweetCaptionBot) LookupTweets(ids []int64) (twigger.Tweets, error) {
+	found := map[int64]twigger.Tweet{}
+	for start := 0; start < len(ids); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var batch []anaconda.Tweet
+		err := b.request(func() (err error) {
+			batch, err = b.TwiggerConn.Client.GetTweetsLookupByIds(ids[start:end], extendedValues())
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, tw := range batch {
+			found[tw.Id] = twigger.Tweet(tw)
+		}
+	}
+
+	tweets := twigger.Tweets{}
+	for _, id := range ids {
+		if tw, ok := found[id]; ok {
+			tweets = append(tweets, tw)
+			delete(found, id)
+		}
+	}
+	return tweets, nil
+}
+
+// SearchTweets retrieves recent tweets matching the query, at most max of
+// them unless max is 0. The standard search API only covers the last 7 days.
+func (b *TweetCaptionBot) SearchTweets(query string, max int) (twigger.Tweets, error) {
+	v := extendedValues()
+	v.Set("count", strconv.Itoa(searchPageSize))
+	v.Set("result_type", "recent")
+
+	tweets := twigger.Tweets{}
+	var resp anaconda.SearchResponse
+	err := b.request(func() (err error) {
+		resp, err = b.TwiggerConn.Client.GetSearch(query, v)
+		return err
+	})
+	for err == nil && len(resp.Statuses) > 0 {
+		for _, tw := range resp.Statuses {
+			tweets = append(tweets, twigger.Tweet(tw))
+		}
+		if max > 0 && len(tweets) >= max {
+			return tweets[:max], nil
+		}
+		err = b.request(func() error {
+			next, err := resp.GetNext(b.TwiggerConn.Client)
+			if err == nil {
+				resp = next
+			}
+			return err
+		})
+	}
+	return tweets, err
+}
+
+// GetListTweets retrieves recent tweets of the members of the list, at most
+// max of them unless max is 0.
+func (b *TweetCaptionBot) GetListTweets(listID int64, max int) (twigger.Tweets, error) {
+	v := extendedValues()
+	v.Set("count", strconv.Itoa(listPageSize))
+
+	tweets := twigger.Tweets{}
+	for {
+		var page []anaconda.Tweet
+		err := b.request(func() (err error) {
+			page, err = b.TwiggerConn.Client.GetListTweets(listID, true, v)
+			return err
+		})
+		if err != nil {
+			return tweets, err
+		}
+		if len(page) == 0 {
+			return tweets, nil
+		}
+		for _, tw := range page {
+			tweets = append(tweets, twigger.Tweet(tw))
+		}
+		if max > 0 && len(tweets) >= max {
+			return tweets[:max], nil
+		}
+		v.Set("max_id", strconv.FormatInt(page[len(page)-1].Id-1, 10))
+	}
+}
+
+// GetBookmarks retrieves the bookmarks of the user the token belongs to, at
+// most max of them unless max is 0. Bookmarks are only available through API
+// v2 with an OAuth 2.0 user access token that has the bookmark.read,
+// tweet.read and users.read scopes; app-only bearer tokens are rejected.
+func (b *TweetCaptionBot) GetBookmarks(token string, max int) (twigger.Tweets, error) {
+	me := struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	err := b.request(func() error {
+		return bearerJSONRequest(token, usersMeURL, nil, &me)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int64{}
+	query := url.Values{"max_results": {strconv.Itoa(bookmarkPage)}}
+	for {
+		page := struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			Meta struct {
+				NextToken string `json:"next_token"`
+			} `json:"meta"`
+		}{}
+		err := b.request(func() error {
+			return bearerJSONRequest(token, fmt.Sprintf(bookmarksURL, me.Data.ID), query, &page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, tw := range page.Data {
+			id, err := strconv.ParseInt(tw.ID, 10, 64)
+			if err == nil {
+				ids = append(ids, id)
+			}
+		}
+		if max > 0 && len(ids) >= max {
+			ids = ids[:max]
+			break
+		}
+		if page.Meta.NextToken == "" {
+			break
+		}
+		query.Set("pagination_token", page.Meta.NextToken)
+	}
+	return b.LookupTweets(ids)
+}
+
+// bearerJSONRequest issues a GET request authorized with an OAuth 2.0 token
+// and decodes the response into out.
+func bearerJSONRequest(token, urlStr string, query url.Values, out interface{}) error {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return anaconda.NewApiError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,296 @@
+package twcapbot
+
+import (
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Fonts are parsed once and shared, faces are created per rendering as they
+// are not safe for concurrent use.
+var fontCache = struct {
+	sync.Mutex
+	fonts map[string]*sfnt.Font
+}{fonts: map[string]*sfnt.Font{}}
+
+const (
+	builtinRegular = "builtin:goregular"
+	builtinBold    = "builtin:gobold"
+)
+
+// loadFont parses the TrueType or OpenType font at path. Empty path and the
+// builtin names refer to the Go fonts.
+func loadFont(path string) (*sfnt.Font, error) {
+	if path == "" {
+		path = builtinRegular
+	}
+	fontCache.Lock()
+	defer fontCache.Unlock()
+	if f, ok := fontCache.fonts[path]; ok {
+		return f, nil
+	}
+
+	var data []byte
+	var err error
+	switch path {
+	case builtinRegular:
+		data = goregular.TTF
+	case builtinBold:
+		data = gobold.TTF
+	default:
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var f *sfnt.Font
+	if strings.HasSuffix(strings.ToLower(path), ".ttc") {
+		var c *sfnt.Collection
+		c, err = sfnt.ParseCollection(data)
+		if err == nil {
+			f, err = c.Font(0)
+		}
+	} else {
+		f, err = opentype.Parse(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fontCache.fonts[path] = f
+	return f, nil
+}
+
+// Fonts commonly installed on Linux and macOS that cover scripts the Go fonts
+// lack, e.g. Arabic, Hebrew and CJK.
+var systemFallbackFonts = []string{
+	"/usr/share/fonts/truetype/dejavu/DejaVuSans.ttf",
+	"/usr/share/fonts/truetype/noto/NotoSansArabic-Regular.ttf",
+	"/usr/share/fonts/truetype/noto/NotoSansHebrew-Regular.ttf",
+	"/usr/share/fonts/opentype/noto/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/noto-cjk/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/google-noto-cjk/NotoSansCJK-Regular.ttc",
+	"/usr/share/fonts/truetype/droid/DroidSansFallbackFull.ttf",
+	// Monochrome emoji, sfnt can't draw color emoji fonts
+	"/usr/share/fonts/truetype/noto/NotoEmoji-Regular.ttf",
+	"/usr/share/fonts/noto/NotoEmoji-Regular.ttf",
+	"/usr/share/fonts/google-noto-emoji/NotoEmoji-Regular.ttf",
+	"/usr/share/fonts/truetype/ancient-scripts/Symbola_hint.ttf",
+	"/usr/share/fonts/gdouros-symbola/Symbola.ttf",
+	"/System/Library/Fonts/Supplemental/Arial Unicode.ttf",
+	"/Library/Fonts/Arial Unicode.ttf",
+}
+
+// SystemFallbackFonts returns the paths of installed fonts that cover
+// scripts the Go fonts lack.
+func SystemFallbackFonts() []string {
+	paths := []string{}
+	for _, path := range systemFallbackFonts {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// textFace draws text with a primary font and falls back to further fonts
+// for the glyphs the primary font lacks, e.g. emoji or CJK characters.
+type textFace struct {
+	fonts []*sfnt.Font
+	faces []font.Face
+	buf   sfnt.Buffer
+}
+
+func newTextFace(size float64, paths ...string) (*textFace, error) {
+	t := &textFace{}
+	for _, path := range paths {
+		f, err := loadFont(path)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.fonts = append(t.fonts, f)
+		t.faces = append(t.faces, face)
+	}
+	return t, nil
+}
+
+func (t *textFace) Close() {
+	for _, face := range t.faces {
+		face.Close()
+	}
+}
+
+func (t *textFace) faceFor(r rune) font.Face {
+	for i, f := range t.fonts {
+		idx, err := f.GlyphIndex(&t.buf, r)
+		if err == nil && idx != 0 {
+			return t.faces[i]
+		}
+	}
+	return t.faces[0]
+}
+
+func (t *textFace) hasGlyph(r rune) bool {
+	for _, f := range t.fonts {
+		idx, err := f.GlyphIndex(&t.buf, r)
+		if err == nil && idx != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// visual prepares a line in logical order for drawing.
+func (t *textFace) visual(line string, rtl bool) string {
+	s, _ := t.visualMarked(line, nil, rtl)
+	return s
+}
+
+// visualMarked prepares a line like visual and reorders marked, a flag for
+// each rune of line, along with it. marked may be nil.
+func (t *textFace) visualMarked(line string, marked []bool, rtl bool) (string, []bool) {
+	shaped, src := shapeArabicIndex([]rune(line), t.hasGlyph)
+	visual, order := visualOrderIndex(shaped, rtl)
+	if marked == nil {
+		return string(visual), nil
+	}
+	vmarked := make([]bool, len(visual))
+	for i, k := range order {
+		vmarked[i] = marked[src[k]]
+	}
+	return string(visual), vmarked
+}
+
+// markRanges returns a flag for each rune of text telling whether it falls
+// into one of the byte ranges.
+func markRanges(text string, ranges [][]int) []bool {
+	marked := make([]bool, 0, len(text))
+	i := 0
+	for pos := range text {
+		for i < len(ranges) && ranges[i][1] <= pos {
+			i++
+		}
+		marked = append(marked, i < len(ranges) && ranges[i][0] <= pos)
+	}
+	return marked
+}
+
+func (t *textFace) ascent() int {
+	return t.faces[0].Metrics().Ascent.Ceil()
+}
+
+func (t *textFace) lineHeight() int {
+	m := t.faces[0].Metrics()
+	return (m.Height * 5 / 4).Ceil()
+}
+
+// measure returns the width of s in pixels.
+func (t *textFace) measure(s string) int {
+	w := fixed.Int26_6(0)
+	for _, r := range s {
+		adv, _ := t.faceFor(r).GlyphAdvance(r)
+		w += adv
+	}
+	return w.Ceil()
+}
+
+// draw draws s with its baseline at y, starting from x.
+func (t *textFace) draw(dst draw.Image, x, y int, s string, col color.Color) {
+	t.drawHighlighted(dst, x, y, s, col, col, nil)
+}
+
+// drawHighlighted draws s like draw, runes of s whose flag in marked is set
+// are drawn with accent. s and marked are in visual order, see visualMarked.
+func (t *textFace) drawHighlighted(dst draw.Image, x, y int, s string, col, accent color.Color, marked []bool) {
+	if accent == nil {
+		accent = col
+	}
+	plain, highlighted := image.NewUniform(col), image.NewUniform(accent)
+	d := font.Drawer{Dst: dst, Dot: fixed.P(x, y)}
+	for i, r := range []rune(s) {
+		d.Src = plain
+		if i < len(marked) && marked[i] {
+			d.Src = highlighted
+		}
+		d.Face = t.faceFor(r)
+		d.DrawString(string(r))
+	}
+}
+
+// wrap breaks text into lines no wider than width. Lines break at spaces,
+// around CJK characters and at explicit newlines. Words longer than a line
+// are broken where they overflow.
+func (t *textFace) wrap(text string, width int) []string {
+	runes := []rune(text)
+	lines := []string{}
+	for _, span := range t.wrapRunes(runes, width) {
+		lines = append(lines, string(runes[span[0]:span[1]]))
+	}
+	return lines
+}
+
+// wrapRunes breaks runes into lines like wrap and returns the start and end
+// index of each line, so that flags of the runes can follow them.
+func (t *textFace) wrapRunes(runes []rune, width int) [][2]int {
+	lines := [][2]int{}
+	// trimRight returns the line from start to end without trailing spaces.
+	trimRight := func(start, end int) [2]int {
+		for end > start && unicode.IsSpace(runes[end-1]) {
+			end--
+		}
+		return [2]int{start, end}
+	}
+
+	start, lastBreak := 0, 0
+	for i := 0; i <= len(runes); i++ {
+		if i == len(runes) || runes[i] == '\n' {
+			lines = append(lines, trimRight(start, i))
+			start, lastBreak = i+1, 0
+			continue
+		}
+		r := runes[i]
+		n := i - start
+		if n > 0 && (isCJK(r) || isCJK(runes[i-1])) {
+			lastBreak = n
+		}
+		n++
+		if unicode.IsSpace(r) {
+			lastBreak = n
+		}
+		if t.measure(string(runes[start:i+1])) <= width || n == 1 {
+			continue
+		}
+
+		cut := lastBreak
+		if cut == 0 {
+			cut = n - 1
+		}
+		lines = append(lines, trimRight(start, start+cut))
+		start += cut
+		for start <= i && unicode.IsSpace(runes[start]) {
+			start++
+		}
+		lastBreak = 0
+	}
+	return lines
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
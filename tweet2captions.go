@@ -22,8 +22,8 @@ var (
 )
 
 // This function should be called shortly after the bot is created
-func SetBotScreenName(botScreenName string) {
-	botScreenName = botScreenName
+func SetBotScreenName(screenName string) {
+	botScreenName = screenName
 	botAndScreenName = fmt.Sprintf("%v (@%v)", BotName, botScreenName)
 	endNotes1 = fmt.Sprintf("Generated by %v.", botAndScreenName)
 	endNotes2 = "The bot is currently at it's early beta stage."
@@ -34,67 +34,109 @@ func SetBotScreenName(botScreenName string) {
 	gifNote = fmt.Sprintf("%v cannot propery captionize tweets with GIF images for now", botAndScreenName)
 }
 
-func GetCaptionsForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet) []string {
-	captions := make([]string, 0)
-	warningNote := []string{}
-	textNote := ""
-	infoNote := ""
+// CaptionData is the structured content of a tweet that captions and alt
+// texts are built from. Its fields are plain text, they have to be escaped
+// before they are put into HTML captions.
+type CaptionData struct {
+	Name       string
+	ScreenName string
+	Action     string // tweet or retweet
+	Text       string
+	Lang       string // Language Twitter detected for Text, empty if unknown
+	URL        string
+
+	// Set only for quote tweets
+	QuoterName       string
+	QuoterScreenName string
+	Quoted           *CaptionData
+
+	Warnings []string
+}
 
+func GetCaptionDataForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet) CaptionData {
 	action := "tweet"
 	if tw.Retweeted {
 		action = "retweet"
 	}
+	data := CaptionData{
+		Name:       tw.User.Name,
+		ScreenName: tw.User.ScreenName,
+		Action:     action,
+		Text:       TweetText(tw),
+		Lang:       TweetLanguage(tw.Lang),
+		URL:        GetTweetURL(tw),
+		Warnings:   []string{},
+	}
 
-	if quotedTweet == nil {
-		textNote = fmt.Sprintf("%v (@%v) %ved: %v", tw.User.Name, tw.User.ScreenName, action, tw.FullText)
-		infoNote = fmt.Sprintf(infoNoteTempl, GetTweetURL(tw))
-
-		if tw.ContainsVideo() {
-			warningNote = append(warningNote, videoNote)
-		}
-		if tw.ContainsGIF() {
-			warningNote = append(warningNote, gifNote)
-		}
-	} else {
-		textNote = fmt.Sprintf("%v (@%v) tweeted: %v <br/><br/>", tw.User.Name, tw.User.ScreenName, tw.FullText)
-		quoterScreenName := tw.User.ScreenName
-		quoterName := tw.User.Name
+	mediaTweet := tw
+	if quotedTweet != nil {
+		data.QuoterName = tw.User.Name
+		data.QuoterScreenName = tw.User.ScreenName
 		if tw.RetweetedStatus != nil {
-			quoterScreenName = tw.RetweetedStatus.User.ScreenName
+			data.QuoterScreenName = tw.RetweetedStatus.User.ScreenName
 		}
-
-		textNote += fmt.Sprintf("%v (@%v) quoted tweet of %v <br/><br/>", quoterName, quoterScreenName, quotedTweet.User.ScreenName) // (???)
-		textNote += fmt.Sprintf("Original tweet's content: %v <br/><br/>", tw.FullText)
-		textNote += fmt.Sprintf("Quoted tweet's content: %v", quotedTweet.FullText)
-
-		url := strings.TrimPrefix(GetTweetURL(tw), "https://www.")
-		originalTweetInfoNote := fmt.Sprintf(infoNoteTempl, url)
-		quotedTweetInfoNote := fmt.Sprintf(infoNoteTempl, url)
-		infoNote = fmt.Sprintf("Original Tweet URL: %v <br/><br/>Quoted tweet URL: %v", originalTweetInfoNote, quotedTweetInfoNote)
+		quoted := GetCaptionDataForTweet(*quotedTweet, nil)
+		quoted.Warnings = []string{}
+		data.Quoted = &quoted
 
 		originalTweetHasSpecialMedia := tw.ContainsGIF() || tw.ContainsVideo()
 		quotedTweetHasSpecialMedia := quotedTweet.ContainsGIF() || quotedTweet.ContainsVideo()
+		if !originalTweetHasSpecialMedia && quotedTweetHasSpecialMedia {
+			mediaTweet = *quotedTweet
+		}
+	}
 
-		if originalTweetHasSpecialMedia {
-			if tw.ContainsVideo() {
-				warningNote = append(warningNote, videoNote)
-			}
-			if tw.ContainsGIF() {
-				warningNote = append(warningNote, gifNote)
-			}
-		} else if quotedTweetHasSpecialMedia {
-			if quotedTweet.ContainsVideo() {
-				warningNote = append(warningNote, videoNote)
-			}
-			if quotedTweet.ContainsGIF() {
-				warningNote = append(warningNote, gifNote)
-			}
+	if mediaTweet.ContainsVideo() {
+		data.Warnings = append(data.Warnings, videoNote)
+	}
+	if mediaTweet.ContainsGIF() {
+		data.Warnings = append(data.Warnings, gifNote)
+	}
+	return data
+}
+
+// GetCaptionsForTweet returns the caption blocks of a tweet. The metadata
+// section is added if meta is given and opts select any of its fields.
+func GetCaptionsForTweet(tw twigger.Tweet, quotedTweet *twigger.Tweet, opts CaptionOptions, meta *TweetMetadata) []Caption {
+	data := GetCaptionDataForTweet(tw, quotedTweet)
+	captions := make([]Caption, 0)
+	infoNote := ""
+
+	textCaption := func(label string, t twigger.Tweet, lang string) Caption {
+		text := ExpandTweetText(t, opts.FullURLs)
+		if opts.StyleEntities {
+			return NewStyledTextCaption(label, text, lang, EntityTokens(t))
 		}
+		return NewTextCaption(label, text, lang)
+	}
+
+	if data.Quoted == nil {
+		label := fmt.Sprintf("<bdi>%v</bdi> (@%v) %ved:", EscapeCaptionText(data.Name), data.ScreenName, data.Action)
+		captions = append(captions, textCaption(label, tw, data.Lang))
+		infoNote = fmt.Sprintf(infoNoteTempl, data.URL)
+	} else {
+		quoted := data.Quoted
+		label := fmt.Sprintf("<bdi>%v</bdi> (@%v) tweeted:", EscapeCaptionText(data.Name), data.ScreenName)
+		captions = append(captions, textCaption(label, tw, data.Lang))
+		quoteNote := fmt.Sprintf("<bdi>%v</bdi> (@%v) quoted tweet of %v", EscapeCaptionText(data.QuoterName), data.QuoterScreenName, quoted.ScreenName)
+		captions = append(captions, NewNoteCaption(quoteNote))
+		captions = append(captions, textCaption("Quoted tweet's content:", *quotedTweet, quoted.Lang))
+
+		originalTweetInfoNote := fmt.Sprintf(infoNoteTempl, strings.TrimPrefix(data.URL, "https://www."))
+		quotedTweetInfoNote := fmt.Sprintf(infoNoteTempl, strings.TrimPrefix(quoted.URL, "https://www."))
+		infoNote = fmt.Sprintf("Original Tweet URL: %v <br/><br/>Quoted tweet URL: %v", originalTweetInfoNote, quotedTweetInfoNote)
 	}
 
-	captions = append(captions, textNote, infoNote)
-	captions = append(captions, warningNote...)
-	captions = append(captions, endNotes)
+	captions = append(captions, NewNoteCaption(infoNote))
+	if meta != nil {
+		if c, ok := MetadataCaption(*meta, opts.Metadata); ok {
+			captions = append(captions, c)
+		}
+	}
+	for _, warning := range data.Warnings {
+		captions = append(captions, NewNoteCaption(warning))
+	}
+	captions = append(captions, NewNoteCaption(endNotes))
 
 	return captions
 }
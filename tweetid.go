@@ -0,0 +1,87 @@
+package twcapbot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Hosts serving tweets under /<user>/status/<id>, subdomains such as
+// mobile.twitter.com included.
+var tweetHosts = []string{"twitter.com", "x.com", "fxtwitter.com", "vxtwitter.com", "fixupx.com"}
+
+// ParseTweetID returns the ID of a tweet given by its ID or URL. URLs may
+// lack the scheme and may carry query strings, fragments and trailing path
+// segments such as /photo/1.
+func ParseTweetID(s string) (int64, error) {
+	s = strings.Trim(strings.TrimSpace(s), `<>"'()`)
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if id <= 0 {
+			return 0, fmt.Errorf("%q: %w", s, ErrInvalidTweetID)
+		}
+		return id, nil
+	}
+
+	raw := s
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !isTweetHost(u.Hostname()) {
+		return 0, fmt.Errorf("%q: %w", s, ErrInvalidTweetID)
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] != "status" && segments[i] != "statuses" {
+			continue
+		}
+		id, err := strconv.ParseInt(segments[i+1], 10, 64)
+		if err == nil && id > 0 {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("%q: %w", s, ErrInvalidTweetID)
+}
+
+func isTweetHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, h := range tweetHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadTweetIDs reads tweet IDs and URLs separated by white space, commas or
+// new lines, see ParseTweetID. Lines starting with # are comments. IDs are
+// returned in the order they are read without duplicates, entries that
+// aren't tweet IDs or URLs are returned in invalid.
+func ReadTweetIDs(r io.Reader) (ids []int64, invalid []string, err error) {
+	seen := map[int64]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		for _, field := range fields {
+			id, err := ParseTweetID(field)
+			if err != nil {
+				invalid = append(invalid, field)
+				continue
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, invalid, scanner.Err()
+}